@@ -2,4 +2,7 @@ module github.com/suhlig/concourse-resource-proxy
 
 go 1.17
 
-require github.com/gorilla/websocket v1.5.0
+require (
+	github.com/gorilla/websocket v1.5.0
+	gopkg.in/yaml.v3 v3.0.1
+)
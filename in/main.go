@@ -7,11 +7,8 @@ package main
 import (
 	"encoding/json"
 	"log"
-	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
-	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -19,11 +16,7 @@ import (
 )
 
 type InRequest struct {
-	Source struct {
-		URL     string
-		Token   string
-		Proxied json.RawMessage `json:"proxied"`
-	} `json:"source"`
+	Source  models.Source     `json:"source"`
 	Version map[string]string `json:"version"`
 	Params  map[string]string `json:"params"`
 }
@@ -54,37 +47,25 @@ func main() {
 		log.Fatal(err)
 	}
 
-	url, err := url.Parse(request.Source.URL)
-
-	if err != nil {
-		log.Fatal("parse:", err)
-	}
-
-	if !(url.Scheme == "ws" || url.Scheme == "wss") {
-		log.Fatal("Error: uri scheme must be ws or wss")
-	}
-
-	if !strings.HasSuffix(url.Path, "/") {
-		url.Path = url.Path + "/"
+	if err := models.RedactLog(request.Source); err != nil {
+		log.Fatalf("Error: %s", err)
 	}
 
-	url.Path = url.Path + "in"
-
-	log.Printf("proxying in to %s: ", url.String())
-
-	ws, response, err := websocket.DefaultDialer.Dial(url.String(), http.Header{
-		"Authorization": []string{request.Source.Token},
-	})
+	ws, err := models.Dial(request.Source, "in")
 
 	if err != nil {
-		log.Fatalf("Could not connect: %s (error %v)", err, response.Status)
+		log.Fatalf("Error: %s", err)
 	}
 
 	defer ws.Close()
 
 	done := make(chan struct{})
+	var exitStatus int
 
-	go models.ReceiveFiles(ws, destinationDirectory, "I", done)
+	go func() {
+		defer close(done)
+		exitStatus = models.Receive(ws, destinationDirectory, "I")
+	}()
 
 	message, err := json.Marshal(InMessage{
 		Source:  request.Source.Proxied,
@@ -108,6 +89,12 @@ func main() {
 	for {
 		select {
 		case <-done:
+			if exitStatus != 0 {
+				log.Printf("Error: resource exited with status %d", exitStatus)
+				ws.Close()
+				os.Exit(exitStatus)
+			}
+
 			return
 		case <-interrupt:
 			log.Println("interrupt")
@@ -0,0 +1,226 @@
+package models
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The server may need to build the resource before it accepts the connection.
+const handshakeTimeout = 5 * time.Minute
+
+// Headers passed along with the websocket handshake
+const (
+	// git ref of the resource under development that the proxy asks for
+	RefHeader = "X-Concourse-Resource-Ref"
+
+	// commit the ref was resolved to by the server
+	CommitHeader = "X-Concourse-Resource-Commit"
+
+	// profile of executables that the proxy asks for
+	ProfileHeader = "X-Concourse-Resource-Profile"
+
+	// whether the proxy asks for running the resource under the debugger
+	DebugHeader = "X-Concourse-Resource-Debug"
+
+	// name of the resource in the pipeline, as configured in the proxy's source
+	ResourceNameHeader = "X-Concourse-Resource-Name"
+)
+
+// BuildMetadata maps the environment variables with the metadata of the build
+// that Concourse runs in and out for to the headers passing them to the server.
+var BuildMetadata = map[string]string{
+	"BUILD_ID":            "X-Concourse-Build-Id",
+	"BUILD_NAME":          "X-Concourse-Build-Name",
+	"BUILD_JOB_NAME":      "X-Concourse-Build-Job-Name",
+	"BUILD_PIPELINE_NAME": "X-Concourse-Build-Pipeline-Name",
+	"BUILD_TEAM_NAME":     "X-Concourse-Build-Team-Name",
+}
+
+// Source is the configuration of the resource proxy in the pipeline.
+type Source struct {
+	URL     string          `json:"url"`
+	Token   string          `json:"token"`
+	Ref     string          `json:"ref"`
+	Profile string          `json:"profile"`
+	Debug   bool            `json:"debug"`
+	Name    string          `json:"name"`
+	Proxied json.RawMessage `json:"proxied"`
+
+	// PEM-encoded certificate of the CA that signed the server's certificate
+	CACert string `json:"ca_cert"`
+
+	// do not verify the server's certificate at all
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+
+	// prove knowledge of the token instead of sending it, and let the server
+	// prove it, too
+	Sign bool `json:"sign"`
+
+	// encrypt the messages with keys derived from the token; implies Sign
+	Encrypt bool `json:"encrypt"`
+
+	// patterns of JSON keys to redact in the log, in addition to SensitiveKeys
+	Redact []string `json:"redact"`
+
+	// PEM-encoded certificate and key to authenticate with instead of the token
+	ClientCert string `json:"client_cert"`
+	ClientKey  string `json:"client_key"`
+}
+
+// Dial connects to the resource server's endpoint for operation.
+func Dial(source Source, operation string) (*Conn, error) {
+	url, err := url.Parse(source.URL)
+
+	if err != nil {
+		return nil, fmt.Errorf("parse: %w", err)
+	}
+
+	if !(url.Scheme == "ws" || url.Scheme == "wss") {
+		return nil, errors.New("uri scheme must be ws or wss")
+	}
+
+	if !strings.HasSuffix(url.Path, "/") {
+		url.Path = url.Path + "/"
+	}
+
+	url.Path = url.Path + operation
+
+	log.Printf("proxying %s to %s: ", operation, url.String())
+
+	dialer := *websocket.DefaultDialer
+	dialer.HandshakeTimeout = handshakeTimeout
+
+	if url.Scheme == "wss" {
+		dialer.TLSClientConfig, err = tlsConfig(source)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	header := http.Header{}
+
+	// the token must not travel in clear text, as it is the key
+	if source.Encrypt {
+		source.Sign = true
+		header.Set(EncryptionHeader, EncryptionScheme)
+	}
+
+	if source.Ref != "" {
+		header.Set(RefHeader, source.Ref)
+	}
+
+	if source.Profile != "" {
+		header.Set(ProfileHeader, source.Profile)
+	}
+
+	if source.Debug {
+		header.Set(DebugHeader, "true")
+	}
+
+	if source.Name != "" {
+		header.Set(ResourceNameHeader, source.Name)
+	}
+
+	for variable, name := range BuildMetadata {
+		if value := os.Getenv(variable); value != "" {
+			header.Set(name, value)
+		}
+	}
+
+	var signature Signature
+
+	// after all other headers, as it covers them
+	if source.Sign {
+		signature, err = NewSignature(source.Token, operation, header)
+
+		if err != nil {
+			return nil, err
+		}
+
+		header.Set("Authorization", signature.String())
+	} else {
+		header.Set("Authorization", source.Token)
+	}
+
+	ws, response, err := dialer.Dial(url.String(), header)
+
+	if err != nil {
+		if response != nil {
+			return nil, readError(response, operation)
+		}
+
+		return nil, fmt.Errorf("could not connect: %w", err)
+	}
+
+	if source.Sign && !signature.VerifyServerProof(source.Token, operation, header, response.Header.Get(ServerSignatureHeader)) {
+		ws.Close()
+		return nil, errors.New("the server could not prove that it knows the token")
+	}
+
+	if commit := response.Header.Get(CommitHeader); commit != "" {
+		log.Printf("resource server runs %s at commit %s", source.Ref, commit)
+	}
+
+	if !source.Encrypt {
+		return NewConn(ws), nil
+	}
+
+	serverNonce := response.Header.Get(EncryptionHeader)
+
+	if serverNonce == "" {
+		ws.Close()
+		return nil, errors.New("the server does not encrypt the session")
+	}
+
+	encryption := Encryption{
+		Secret:      source.Token,
+		Operation:   operation,
+		Signature:   signature,
+		ServerNonce: serverNonce,
+	}
+
+	return encryption.Wrap(ws, "proxy")
+}
+
+// tlsConfig returns the configuration for verifying the server as configured
+// in source.
+func tlsConfig(source Source) (*tls.Config, error) {
+	config := &tls.Config{}
+
+	if source.CACert != "" {
+		config.RootCAs = x509.NewCertPool()
+
+		if !config.RootCAs.AppendCertsFromPEM([]byte(source.CACert)) {
+			return nil, errors.New("ca_cert does not contain a PEM-encoded certificate")
+		}
+	}
+
+	if source.ClientCert != "" || source.ClientKey != "" {
+		pair, err := tls.X509KeyPair([]byte(source.ClientCert), []byte(source.ClientKey))
+
+		if err != nil {
+			return nil, fmt.Errorf("client_cert and client_key: %w", err)
+		}
+
+		config.Certificates = []tls.Certificate{pair}
+	}
+
+	if source.InsecureSkipVerify {
+		log.Print("Warning: not verifying the server's certificate")
+		config.InsecureSkipVerify = true
+	}
+
+	return config, nil
+}
@@ -0,0 +1,240 @@
+package models
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// With an encrypted session, the proxy asks for encryption in EncryptionHeader
+// and the server answers with a nonce of its own in the same header. Both sides
+// then encrypt the text and binary messages with keys derived from the token
+// and the nonces of the signed handshake and the server, one for each
+// direction. Control messages are not encrypted, so the server sends the exit
+// status in a last encrypted message before it closes the connection; a session
+// without it was cut off.
+const (
+	EncryptionHeader = "X-Concourse-Resource-Encryption"
+	EncryptionScheme = "AES-256-GCM"
+)
+
+// Encryption is what both sides derive the keys of an encrypted session from.
+type Encryption struct {
+	Secret      string // the token
+	Operation   string
+	Signature   Signature // of the handshake
+	ServerNonce string
+}
+
+// Conn is a websocket connection whose text and binary messages are encrypted
+// if the session is. Like with websocket.Conn, there may be one concurrent
+// reader and one concurrent writer.
+type Conn struct {
+	*websocket.Conn
+
+	seal, open cipher.AEAD // nil if not encrypted
+
+	mu       sync.Mutex
+	sent     uint64 // messages sealed so far, for the nonce
+	received uint64 // messages opened so far, for the nonce
+
+	// from the last message of the server; nil until it arrived
+	exitStatus *int
+}
+
+// Kinds of the plaintext of encrypted messages, which is prefixed with one
+const (
+	dataMessage = iota
+	exitMessage // the server's last one, with the exit status
+)
+
+// NewConn returns ws without encryption.
+func NewConn(ws *websocket.Conn) *Conn {
+	return &Conn{Conn: ws}
+}
+
+// Wrap returns ws with the messages encrypted for role, which is proxy or
+// server.
+func (e Encryption) Wrap(ws *websocket.Conn, role string) (*Conn, error) {
+	peer := "server"
+
+	if role == "server" {
+		peer = "proxy"
+	}
+
+	seal, err := e.aead(role)
+
+	if err != nil {
+		return nil, err
+	}
+
+	open, err := e.aead(peer)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Conn{Conn: ws, seal: seal, open: open}, nil
+}
+
+// aead returns the cipher for the messages sent by role.
+func (e Encryption) aead(role string) (cipher.AEAD, error) {
+	h := hmac.New(sha256.New, []byte(e.Secret))
+	fmt.Fprintf(h, "encryption\n%s\n%s\n%d\n%s\n%s", role, e.Operation, e.Signature.Timestamp, e.Signature.Nonce, e.ServerNonce)
+
+	block, err := aes.NewCipher(h.Sum(nil))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Encrypted tells whether the messages are encrypted.
+func (c *Conn) Encrypted() bool {
+	return c.seal != nil
+}
+
+// WriteMessage writes a message, encrypting text and binary ones.
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	if c.seal == nil || !isDataMessage(messageType) {
+		return c.Conn.WriteMessage(messageType, data)
+	}
+
+	return c.writeSealed(messageType, dataMessage, data)
+}
+
+// writeSealed encrypts data of kind and writes it as a message of messageType.
+func (c *Conn) writeSealed(messageType int, kind byte, data []byte) error {
+	// keep the nonces in the order of the messages on the wire
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	plaintext := append([]byte{kind}, data...)
+	sealed := c.seal.Seal(nil, nonce(c.seal, c.sent), plaintext, []byte{byte(messageType)})
+	c.sent++
+
+	return c.Conn.WriteMessage(messageType, sealed)
+}
+
+// Finish ends the session of a resource that exited with status by closing
+// the connection. If encrypted, the status is sent in a last encrypted message
+// first.
+func (c *Conn) Finish(status int) error {
+	if c.seal != nil {
+		if err := c.writeSealed(websocket.BinaryMessage, exitMessage, []byte(strconv.Itoa(validExitStatus(status)))); err != nil {
+			return err
+		}
+	}
+
+	return c.Conn.WriteMessage(websocket.CloseMessage, CloseMessage(status))
+}
+
+// NextWriter returns a writer for the next message. If encrypted, the message
+// is buffered and sent when the writer is closed.
+func (c *Conn) NextWriter(messageType int) (io.WriteCloser, error) {
+	if c.seal == nil || !isDataMessage(messageType) {
+		return c.Conn.NextWriter(messageType)
+	}
+
+	return &sealingWriter{conn: c, messageType: messageType}, nil
+}
+
+// ReadMessage reads the next message, decrypting text and binary ones. The
+// exit status sent by Finish is kept for ExitStatus instead of being returned.
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	for {
+		messageType, data, err := c.Conn.ReadMessage()
+
+		if err != nil || c.open == nil || !isDataMessage(messageType) {
+			return messageType, data, err
+		}
+
+		opened, err := c.open.Open(nil, nonce(c.open, c.received), data, []byte{byte(messageType)})
+
+		if err != nil || len(opened) == 0 {
+			return messageType, nil, errors.New("could not decrypt message; is the session tampered with?")
+		}
+
+		c.received++
+
+		if c.exitStatus != nil {
+			return messageType, nil, errors.New("received a message after the exit status; is the session tampered with?")
+		}
+
+		switch opened[0] {
+		case dataMessage:
+			return messageType, opened[1:], nil
+		case exitMessage:
+			status, err := strconv.Atoi(string(opened[1:]))
+
+			if err != nil {
+				return messageType, nil, fmt.Errorf("invalid exit status: %w", err)
+			}
+
+			c.exitStatus = &status
+		default:
+			return messageType, nil, fmt.Errorf("unknown kind of message %d", opened[0])
+		}
+	}
+}
+
+// ExitStatus returns the exit status of the resource if err is the result of
+// the server closing the connection. In an encrypted session, it is the one
+// from the server's last encrypted message, which must have arrived.
+func (c *Conn) ExitStatus(err error) (int, error) {
+	status, ok := exitStatus(err)
+
+	if !ok {
+		return 0, err
+	}
+
+	if c.open == nil {
+		return status, nil
+	}
+
+	if c.exitStatus == nil {
+		return 0, errors.New("the session ended without the encrypted exit status; was it cut off?")
+	}
+
+	return *c.exitStatus, nil
+}
+
+// nonce returns the nonce of the message with the given sequence number. Each
+// key is used for one session and direction only, so counting is sufficient.
+func nonce(aead cipher.AEAD, sequence uint64) []byte {
+	n := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(n[len(n)-8:], sequence)
+
+	return n
+}
+
+func isDataMessage(messageType int) bool {
+	return messageType == websocket.TextMessage || messageType == websocket.BinaryMessage
+}
+
+// sealingWriter buffers a message until it is closed.
+type sealingWriter struct {
+	conn        *Conn
+	messageType int
+	buffer      bytes.Buffer
+}
+
+func (w *sealingWriter) Write(p []byte) (int, error) {
+	return w.buffer.Write(p)
+}
+
+func (w *sealingWriter) Close() error {
+	return w.conn.WriteMessage(w.messageType, w.buffer.Bytes())
+}
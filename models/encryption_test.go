@@ -0,0 +1,290 @@
+package models
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// connect returns the proxy's end of a websocket connection whose server end is
+// handed to serve.
+func connect(t *testing.T, serve func(*websocket.Conn)) *websocket.Conn {
+	upgrader := websocket.Upgrader{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		defer ws.Close()
+		serve(ws)
+	}))
+
+	t.Cleanup(server.Close)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { ws.Close() })
+
+	return ws
+}
+
+// sealed returns the message with the given sequence number as c would send
+// it.
+func sealed(c *Conn, sequence uint64, messageType int, kind byte, data string) []byte {
+	return c.seal.Seal(nil, nonce(c.seal, sequence), append([]byte{kind}, data...), []byte{byte(messageType)})
+}
+
+func TestEncryptionWrap(t *testing.T) {
+	signature, err := NewSignature("s3cret", "in", http.Header{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encryption := Encryption{Secret: "s3cret", Operation: "in", Signature: signature, ServerNonce: "abc"}
+
+	tests := []struct {
+		name       string
+		server     Encryption // of the server, if other than the proxy's
+		serve      func(*Conn) error
+		want       []string // messages received by the proxy
+		wantStatus int
+		wantErr    bool
+	}{
+		{
+			name: "round trip",
+			serve: func(c *Conn) error {
+				if err := c.WriteMessage(websocket.TextMessage, []byte("request")); err != nil {
+					return err
+				}
+
+				w, err := c.NextWriter(websocket.BinaryMessage)
+
+				if err != nil {
+					return err
+				}
+
+				w.Write([]byte("file"))
+				w.Close()
+
+				return c.Finish(3)
+			},
+			want:       []string{"request", "file"},
+			wantStatus: 3,
+		},
+		{
+			name:   "other key",
+			server: Encryption{Secret: "guessed", Operation: "in", Signature: signature, ServerNonce: "abc"},
+			serve: func(c *Conn) error {
+				return c.WriteMessage(websocket.TextMessage, []byte("request"))
+			},
+			wantErr: true,
+		},
+		{
+			name: "altered ciphertext",
+			serve: func(c *Conn) error {
+				message := sealed(c, 0, websocket.BinaryMessage, dataMessage, "file")
+				message[0] ^= 1
+
+				return c.Conn.WriteMessage(websocket.BinaryMessage, message)
+			},
+			wantErr: true,
+		},
+		{
+			name: "altered message type",
+			serve: func(c *Conn) error {
+				return c.Conn.WriteMessage(websocket.TextMessage, sealed(c, 0, websocket.BinaryMessage, dataMessage, "file"))
+			},
+			wantErr: true,
+		},
+		{
+			name: "reordered",
+			serve: func(c *Conn) error {
+				if err := c.Conn.WriteMessage(websocket.BinaryMessage, sealed(c, 1, websocket.BinaryMessage, dataMessage, "second")); err != nil {
+					return err
+				}
+
+				return c.Conn.WriteMessage(websocket.BinaryMessage, sealed(c, 0, websocket.BinaryMessage, dataMessage, "first"))
+			},
+			wantErr: true,
+		},
+		{
+			name: "replayed",
+			serve: func(c *Conn) error {
+				message := sealed(c, 0, websocket.BinaryMessage, dataMessage, "file")
+
+				if err := c.Conn.WriteMessage(websocket.BinaryMessage, message); err != nil {
+					return err
+				}
+
+				return c.Conn.WriteMessage(websocket.BinaryMessage, message)
+			},
+			want:    []string{"file"},
+			wantErr: true,
+		},
+		{
+			name: "left out",
+			serve: func(c *Conn) error {
+				return c.Conn.WriteMessage(websocket.BinaryMessage, sealed(c, 1, websocket.BinaryMessage, dataMessage, "second"))
+			},
+			wantErr: true,
+		},
+		{
+			name: "unencrypted",
+			serve: func(c *Conn) error {
+				return c.Conn.WriteMessage(websocket.TextMessage, []byte("request"))
+			},
+			wantErr: true,
+		},
+		{
+			name: "cut off before the exit status",
+			serve: func(c *Conn) error {
+				if err := c.WriteMessage(websocket.TextMessage, []byte("request")); err != nil {
+					return err
+				}
+
+				return c.Conn.WriteMessage(websocket.CloseMessage, CloseMessage(0))
+			},
+			want:    []string{"request"},
+			wantErr: true,
+		},
+		{
+			name: "altered close frame",
+			serve: func(c *Conn) error {
+				if err := c.writeSealed(websocket.BinaryMessage, exitMessage, []byte("0")); err != nil {
+					return err
+				}
+
+				return c.Conn.WriteMessage(websocket.CloseMessage, CloseMessage(3))
+			},
+			wantStatus: 0,
+		},
+		{
+			name: "message after the exit status",
+			serve: func(c *Conn) error {
+				if err := c.writeSealed(websocket.BinaryMessage, exitMessage, []byte("0")); err != nil {
+					return err
+				}
+
+				if err := c.WriteMessage(websocket.TextMessage, []byte("more")); err != nil {
+					return err
+				}
+
+				return c.Conn.WriteMessage(websocket.CloseMessage, CloseMessage(0))
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := test.server
+
+			if server.Secret == "" {
+				server = encryption
+			}
+
+			ws := connect(t, func(ws *websocket.Conn) {
+				c, err := server.Wrap(ws, "server")
+
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				if err := test.serve(c); err != nil {
+					t.Error(err)
+				}
+
+				// until the proxy is done
+				ws.ReadMessage()
+			})
+
+			c, err := encryption.Wrap(ws, "proxy")
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var received []string
+
+			for {
+				_, data, e := c.ReadMessage()
+
+				if e != nil {
+					err = e
+					break
+				}
+
+				received = append(received, string(data))
+			}
+
+			status, err := c.ExitStatus(err)
+
+			if strings.Join(received, ",") != strings.Join(test.want, ",") {
+				t.Errorf("received %q, want %q", received, test.want)
+			}
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ExitStatus() error = %v, want error %v", err, test.wantErr)
+			}
+
+			if err == nil && status != test.wantStatus {
+				t.Errorf("ExitStatus() = %d, want %d", status, test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestEncryptionWrapToServer(t *testing.T) {
+	signature, err := NewSignature("s3cret", "out", http.Header{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encryption := Encryption{Secret: "s3cret", Operation: "out", Signature: signature, ServerNonce: "abc"}
+	received := make(chan string, 1)
+
+	ws := connect(t, func(ws *websocket.Conn) {
+		c, err := encryption.Wrap(ws, "server")
+
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		_, data, err := c.ReadMessage()
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		received <- string(data)
+	})
+
+	c, err := encryption.Wrap(ws, "proxy")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.WriteMessage(websocket.TextMessage, []byte("request")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := <-received; got != "request" {
+		t.Errorf("server received %q, want %q", got, "request")
+	}
+}
@@ -0,0 +1,54 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Error is sent by the resource server as JSON body of a non-successful
+// response when it cannot serve a request.
+type Error struct {
+	Operation string `json:"operation"`
+	Message   string `json:"error"`
+}
+
+func (e Error) Error() string {
+	return e.Message
+}
+
+// ErrNotAvailable is the message for operations the server was not configured with.
+const ErrNotAvailable = "operation not available"
+
+// The websocket dialer reads no more than 1024 bytes of the body of a failed
+// handshake, so longer messages (e.g. compile errors) are cut short.
+const maxMessageLength = 900
+
+// WriteError responds with status and e as JSON body.
+func WriteError(w http.ResponseWriter, status int, e Error) {
+	if len(e.Message) > maxMessageLength {
+		e.Message = e.Message[:maxMessageLength] + "\n[truncated; see the server log for the full message]"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(e)
+}
+
+// readError turns the response of a failed websocket handshake into an error
+// suitable for the build log.
+func readError(response *http.Response, operation string) error {
+	body, _ := io.ReadAll(response.Body)
+
+	if strings.HasPrefix(response.Header.Get("Content-Type"), "application/json") {
+		var e Error
+
+		if json.Unmarshal(body, &e) == nil {
+			return fmt.Errorf("resource server cannot serve %s: %w (%s)", operation, e, response.Status)
+		}
+	}
+
+	return fmt.Errorf("resource server cannot serve %s: %s (%s)", operation, strings.TrimSpace(string(body)), response.Status)
+}
@@ -0,0 +1,54 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+)
+
+// The server passes the exit status of the resource as code of the message that
+// closes the connection, using the range of codes reserved for private use.
+const exitStatusCloseCode = 4000
+
+// CloseMessage is the last message of the server for a resource that exited
+// with status.
+func CloseMessage(status int) []byte {
+	status = validExitStatus(status)
+
+	if status == 0 {
+		return websocket.FormatCloseMessage(websocket.CloseNormalClosure, "done reading STDOUT")
+	}
+
+	return websocket.FormatCloseMessage(exitStatusCloseCode+status, fmt.Sprintf("exit status %d", status))
+}
+
+// validExitStatus returns status if it can be passed to the proxy, or 1.
+func validExitStatus(status int) int {
+	// e.g. killed by a signal
+	if status < 0 || status > 255 {
+		return 1
+	}
+
+	return status
+}
+
+// exitStatus returns the exit status of the resource if err is the result of
+// the server closing the connection.
+func exitStatus(err error) (int, bool) {
+	var closeError *websocket.CloseError
+
+	if !errors.As(err, &closeError) {
+		return 0, false
+	}
+
+	if closeError.Code == websocket.CloseNormalClosure {
+		return 0, true
+	}
+
+	if closeError.Code > exitStatusCloseCode && closeError.Code <= exitStatusCloseCode+255 {
+		return closeError.Code - exitStatusCloseCode, true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,66 @@
+package models
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCloseMessageExitStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		want   int
+	}{
+		{name: "success", status: 0, want: 0},
+		{name: "failure", status: 1, want: 1},
+		{name: "other failure", status: 3, want: 3},
+		{name: "highest", status: 255, want: 255},
+		{name: "too high", status: 256, want: 1},
+		{name: "far too high", status: 70000, want: 1},
+		{name: "signal", status: -1, want: 1},
+		{name: "negative", status: -9, want: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ws := connect(t, func(ws *websocket.Conn) {
+				ws.WriteMessage(websocket.CloseMessage, CloseMessage(test.status))
+				ws.ReadMessage()
+			})
+
+			_, _, err := ws.ReadMessage()
+			status, ok := exitStatus(err)
+
+			if !ok {
+				t.Fatalf("exitStatus(%v) is not an exit status", err)
+			}
+
+			if status != test.want {
+				t.Errorf("exitStatus() = %d, want %d", status, test.want)
+			}
+		})
+	}
+}
+
+func TestExitStatusOfOtherErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{name: "no close error", err: errors.New("connection reset")},
+		{name: "going away", err: &websocket.CloseError{Code: websocket.CloseGoingAway}},
+		{name: "abnormal closure", err: &websocket.CloseError{Code: websocket.CloseAbnormalClosure}},
+		{name: "below the range", err: &websocket.CloseError{Code: exitStatusCloseCode}},
+		{name: "above the range", err: &websocket.CloseError{Code: exitStatusCloseCode + 256}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if status, ok := exitStatus(test.err); ok {
+				t.Errorf("exitStatus(%v) = %d, want none", test.err, status)
+			}
+		})
+	}
+}
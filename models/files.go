@@ -18,7 +18,7 @@ import (
 
 const concourseFileNameHeader = "X-Concourse-Filename"
 
-func SendFiles(ws *websocket.Conn, baseDir string) error {
+func SendFiles(ws *Conn, baseDir string) error {
 	// this is a bit of a hack - we send STDOUT as websocket.TextMessage
 	// and files as websocket.BinaryMessage, so that we can distinguish them.
 	// The files are also wrapped in a multipart container so that we can add the
@@ -55,7 +55,7 @@ func SendFiles(ws *websocket.Conn, baseDir string) error {
 
 	writer.Close()
 
-	return nil
+	return w.Close()
 }
 
 func writeFile(writer *multipart.Writer, baseDir, relativePath string) error {
@@ -85,9 +85,9 @@ func writeFile(writer *multipart.Writer, baseDir, relativePath string) error {
 	return nil
 }
 
-func ReceiveFiles(ws *websocket.Conn, directory, marker string, done chan struct{}) {
-	defer close(done)
-
+// ReceiveFiles reads messages until the files have arrived, which are then
+// written to directory.
+func ReceiveFiles(ws *Conn, directory, marker string) {
 	for {
 		messageType, message, err := ws.ReadMessage()
 
@@ -104,62 +104,100 @@ func ReceiveFiles(ws *websocket.Conn, directory, marker string, done chan struct
 			log.Printf("%s< %s", marker, message)
 			fmt.Println(string(message))
 		case websocket.BinaryMessage:
-			boundary := getBoundary(message) // hack; perhaps create proper Content-Disposition header?
-			mr := multipart.NewReader(bytes.NewReader(message), boundary)
+			writeFiles(message, directory)
+			return
+		default:
+			log.Printf("Unable to handle message type %d", messageType)
+		}
+	}
+}
 
-			for {
-				part, err := mr.NextPart()
+// Receive reads all messages from the server until it closes the connection.
+// Text messages are the resource's STDOUT and printed, binary ones are files
+// and written to directory. Returns the exit status of the resource, or 1 if
+// the connection ended otherwise.
+func Receive(ws *Conn, directory, marker string) int {
+	for {
+		messageType, message, err := ws.ReadMessage()
 
-				if err == io.EOF {
-					return
-				}
+		if err != nil {
+			status, err := ws.ExitStatus(err)
 
-				if err != nil {
-					log.Fatal(err)
-				}
+			if err != nil {
+				// e.g. the connection was lost before the server finished
+				log.Printf("Error: %s", err)
 
-				fileName := part.Header.Get(concourseFileNameHeader)
+				return 1
+			}
 
-				if fileName == "" {
-					log.Printf("Warning: skipping part because it has no %s set", concourseFileNameHeader)
-					continue
-				}
+			return status
+		}
 
-				fullPath := path.Join(directory, path.Dir(fileName))
-				err = os.MkdirAll(fullPath, os.ModePerm)
+		switch messageType {
+		case websocket.TextMessage:
+			log.Printf("%s< %s", marker, message)
+			fmt.Println(string(message))
+		case websocket.BinaryMessage:
+			writeFiles(message, directory)
+		default:
+			log.Printf("Unable to handle message type %d", messageType)
+		}
+	}
+}
 
-				if err != nil {
-					log.Println(err)
-					continue
-				}
+func writeFiles(message []byte, directory string) {
+	boundary := getBoundary(message) // hack; perhaps create proper Content-Disposition header?
+	mr := multipart.NewReader(bytes.NewReader(message), boundary)
 
-				partFile := path.Join(fullPath, path.Base(fileName))
-				f, err := os.Create(partFile)
+	for {
+		part, err := mr.NextPart()
 
-				if err != nil {
-					log.Println(err)
-					continue
-				}
+		if err == io.EOF {
+			return
+		}
 
-				defer f.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
 
-				bytes, err := io.Copy(f, part)
+		fileName := part.Header.Get(concourseFileNameHeader)
 
-				if err != nil {
-					log.Println(err)
-					continue
-				}
+		if fileName == "" {
+			log.Printf("Warning: skipping part because it has no %s set", concourseFileNameHeader)
+			continue
+		}
 
-				log.Printf("Part %q: %d bytes written to %v\n", fileName, bytes, partFile)
-			}
-		default:
-			log.Printf("Unable to handle message type %d", messageType)
+		fullPath := path.Join(directory, path.Dir(fileName))
+		err = os.MkdirAll(fullPath, os.ModePerm)
+
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		partFile := path.Join(fullPath, path.Base(fileName))
+		f, err := os.Create(partFile)
+
+		if err != nil {
+			log.Println(err)
+			continue
 		}
+
+		bytes, err := io.Copy(f, part)
+		f.Close()
+
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		log.Printf("Part %q: %d bytes written to %v\n", fileName, bytes, partFile)
 	}
 }
 
 func getBoundary(message []byte) string {
-	line0 := strings.Split(string(message), "\r\n")[0]
+	// without any parts, there is only the closing delimiter, preceded by CRLF
+	line0 := strings.Split(strings.TrimLeft(string(message), "\r\n"), "\r\n")[0]
 	withoutPrefix := strings.TrimPrefix(line0, "--")
 	return strings.TrimSuffix(withoutPrefix, "--")
 }
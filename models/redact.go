@@ -0,0 +1,235 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Mask replaces secrets.
+const Mask = "((redacted))"
+
+// SensitiveKeys are patterns of the JSON keys whose values are always redacted.
+// They match anywhere in a key, regardless of case, e.g. api_token.
+var SensitiveKeys = []string{"password", "token", "private_key", "secret"}
+
+// Values shorter than this are not masked in free text, as they would be found
+// all over the place.
+const minSecretLength = 6
+
+var privateKeyPattern = regexp.MustCompile(`-----BEGIN[A-Z ]* PRIVATE KEY-----[\s\S]*?-----END[A-Z ]* PRIVATE KEY-----`)
+
+// Redactor masks secrets in JSON and free text:
+//
+//   - values of sensitive keys in JSON, wherever it occurs in the text,
+//   - values following a sensitive key and : or = in free text,
+//   - PEM-encoded private keys, and
+//   - the values that were redacted before or added as secrets.
+type Redactor struct {
+	keys       *regexp.Regexp
+	assignment *regexp.Regexp
+
+	mu      sync.RWMutex
+	secrets map[string]bool
+}
+
+// NewRedactor returns a redactor for the SensitiveKeys and the additional
+// patterns, which are regular expressions.
+func NewRedactor(patterns []string) (*Redactor, error) {
+	var alternatives []string
+
+	for _, pattern := range append(append([]string{}, SensitiveKeys...), patterns...) {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+
+		if _, err := regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("redaction pattern: %w", err)
+		}
+
+		alternatives = append(alternatives, "(?:"+pattern+")")
+	}
+
+	keys := "(?i:" + strings.Join(alternatives, "|") + ")"
+
+	return &Redactor{
+		keys:       regexp.MustCompile(keys),
+		assignment: regexp.MustCompile(`(?i)([\w-]*` + keys + `[\w-]*"?\s*[:=]\s*"?)([^\s",}&]+)`),
+		secrets:    make(map[string]bool),
+	}, nil
+}
+
+// AddSecret masks secret wherever it occurs from now on.
+func (r *Redactor) AddSecret(secret string) {
+	if len(secret) < minSecretLength {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.secrets[secret] = true
+}
+
+// Redact returns text with the secrets masked. The values of sensitive keys are
+// remembered as secrets.
+func (r *Redactor) Redact(text []byte) []byte {
+	text = r.redactJSON(text)
+	text = privateKeyPattern.ReplaceAll(text, []byte(Mask))
+	text = r.assignment.ReplaceAll(text, []byte("${1}"+Mask))
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for secret := range r.secrets {
+		text = bytes.ReplaceAll(text, []byte(secret), []byte(Mask))
+	}
+
+	return text
+}
+
+// RedactString is Redact for strings.
+func (r *Redactor) RedactString(text string) string {
+	return string(r.Redact([]byte(text)))
+}
+
+// redactJSON redacts the JSON objects and arrays within text. The ones without
+// secrets are left as they are.
+func (r *Redactor) redactJSON(text []byte) []byte {
+	var out bytes.Buffer
+
+	for i := 0; i < len(text); {
+		j := bytes.IndexAny(text[i:], "{[")
+
+		if j < 0 {
+			out.Write(text[i:])
+			break
+		}
+
+		start := i + j
+		out.Write(text[i:start])
+
+		decoder := json.NewDecoder(bytes.NewReader(text[start:]))
+		decoder.UseNumber()
+
+		var value interface{}
+
+		if err := decoder.Decode(&value); err != nil {
+			out.WriteByte(text[start])
+			i = start + 1
+			continue
+		}
+
+		end := start + int(decoder.InputOffset())
+
+		if redacted, changed := r.redactValue(value); changed {
+			encoder := json.NewEncoder(&out)
+			encoder.SetEscapeHTML(false)
+			encoder.Encode(redacted)
+			out.Truncate(out.Len() - 1) // newline added by Encode
+		} else {
+			out.Write(text[start:end])
+		}
+
+		i = end
+	}
+
+	return out.Bytes()
+}
+
+// redactValue masks the values of sensitive keys within value.
+func (r *Redactor) redactValue(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		changed := false
+
+		for key, nested := range v {
+			if r.keys.MatchString(key) {
+				r.remember(nested)
+				v[key] = Mask
+				changed = true
+			} else if redacted, c := r.redactValue(nested); c {
+				v[key] = redacted
+				changed = true
+			}
+		}
+
+		return v, changed
+	case []interface{}:
+		changed := false
+
+		for i, nested := range v {
+			if redacted, c := r.redactValue(nested); c {
+				v[i] = redacted
+				changed = true
+			}
+		}
+
+		return v, changed
+	default:
+		return value, false
+	}
+}
+
+// remember adds the strings in value as secrets.
+func (r *Redactor) remember(value interface{}) {
+	switch v := value.(type) {
+	case string:
+		if v != Mask {
+			r.AddSecret(v)
+		}
+	case map[string]interface{}:
+		for _, nested := range v {
+			r.remember(nested)
+		}
+	case []interface{}:
+		for _, nested := range v {
+			r.remember(nested)
+		}
+	}
+}
+
+// Writer returns a writer that redacts everything before writing it to w, e.g.
+// for log.SetOutput.
+func (r *Redactor) Writer(w io.Writer) io.Writer {
+	return redactingWriter{redactor: r, w: w}
+}
+
+type redactingWriter struct {
+	redactor *Redactor
+	w        io.Writer
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	if _, err := w.w.Write(w.redactor.Redact(p)); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// RedactLog lets the proxy mask secrets in everything it logs from now on, also
+// using the patterns in source.redact.
+func RedactLog(source Source) error {
+	redactor, err := NewRedactor(source.Redact)
+
+	if err != nil {
+		return err
+	}
+
+	redactor.AddSecret(source.Token)
+	redactor.AddSecret(source.ClientKey)
+
+	// learn the secrets of the resource under development before they are logged
+	redactor.Redact(source.Proxied)
+
+	log.SetOutput(redactor.Writer(os.Stderr))
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With a signed handshake, the proxy proves in the Authorization header that it
+// knows the token, without sending it:
+//
+//	Authorization: Signature timestamp=<unix seconds>, nonce=<hex>, mac=<hex>
+//
+// The server answers with its own proof in ServerSignatureHeader, so that the
+// proxy knows that it talks to the real server before it sends the request.
+// Both cover the SignedHeaders of the handshake.
+const (
+	SignatureScheme       = "Signature"
+	ServerSignatureHeader = "X-Concourse-Server-Signature"
+
+	// Signatures are accepted only this far from the server's clock.
+	MaxClockSkew = 5 * time.Minute
+)
+
+// SignedHeaders are covered by the signature, in this order, so that nobody in
+// between can change what runs, or on whose behalf.
+var SignedHeaders = signedHeaders()
+
+func signedHeaders() []string {
+	var metadata []string
+
+	for _, name := range BuildMetadata {
+		metadata = append(metadata, name)
+	}
+
+	sort.Strings(metadata)
+
+	return append([]string{RefHeader, ProfileHeader, DebugHeader, ResourceNameHeader, EncryptionHeader}, metadata...)
+}
+
+// Signature signs the handshake for an operation.
+type Signature struct {
+	Timestamp int64
+	Nonce     string
+	MAC       string
+}
+
+// NewSignature signs the handshake for operation with secret, including the
+// SignedHeaders in header.
+func NewSignature(secret, operation string, header http.Header) (Signature, error) {
+	nonce, err := NewNonce()
+
+	if err != nil {
+		return Signature{}, err
+	}
+
+	return Signature{Timestamp: time.Now().Unix(), Nonce: nonce}.Signed(secret, operation, header), nil
+}
+
+// Signed returns s with the MAC of the proxy for its timestamp and nonce.
+func (s Signature) Signed(secret, operation string, header http.Header) Signature {
+	s.MAC = s.mac(secret, "proxy", operation, header)
+
+	return s
+}
+
+// NewNonce returns a random, hex-encoded value to be used once.
+func NewNonce() (string, error) {
+	nonce := make([]byte, 16)
+
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(nonce), nil
+}
+
+// ParseSignature reads the signature from the value of an Authorization header.
+func ParseSignature(header string) (Signature, bool) {
+	var s Signature
+
+	parameters := strings.TrimPrefix(header, SignatureScheme+" ")
+
+	if parameters == header {
+		return s, false
+	}
+
+	for _, parameter := range strings.Split(parameters, ",") {
+		kv := strings.SplitN(strings.TrimSpace(parameter), "=", 2)
+
+		if len(kv) != 2 {
+			return s, false
+		}
+
+		switch kv[0] {
+		case "timestamp":
+			timestamp, err := strconv.ParseInt(kv[1], 10, 64)
+
+			if err != nil {
+				return s, false
+			}
+
+			s.Timestamp = timestamp
+		case "nonce":
+			s.Nonce = kv[1]
+		case "mac":
+			s.MAC = kv[1]
+		}
+	}
+
+	return s, s.Timestamp != 0 && s.Nonce != "" && s.MAC != ""
+}
+
+func (s Signature) String() string {
+	return fmt.Sprintf("%s timestamp=%d, nonce=%s, mac=%s", SignatureScheme, s.Timestamp, s.Nonce, s.MAC)
+}
+
+// Verify tells whether the proxy signed s for operation and header with
+// secret.
+func (s Signature) Verify(secret, operation string, header http.Header) bool {
+	return hmac.Equal([]byte(s.MAC), []byte(s.mac(secret, "proxy", operation, header)))
+}
+
+// ServerProof returns the server's answer to s for the request with header.
+func (s Signature) ServerProof(secret, operation string, header http.Header) string {
+	return s.mac(secret, "server", operation, header)
+}
+
+// VerifyServerProof tells whether the server that answered s, which was sent
+// with header, with proof knows secret.
+func (s Signature) VerifyServerProof(secret, operation string, header http.Header, proof string) bool {
+	return hmac.Equal([]byte(proof), []byte(s.ServerProof(secret, operation, header)))
+}
+
+// mac authenticates the handshake for operation by role; the roles keep the
+// server's proof from being a valid signature of the proxy and vice versa.
+func (s Signature) mac(secret, role, operation string, header http.Header) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(h, "%s\n%s\n%d\n%s", role, operation, s.Timestamp, s.Nonce)
+
+	for _, name := range SignedHeaders {
+		fmt.Fprintf(h, "\n%s: %s", name, header.Get(name))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,158 @@
+package models
+
+import (
+	"net/http"
+	"testing"
+)
+
+func handshakeHeader() http.Header {
+	header := http.Header{}
+	header.Set(RefHeader, "main")
+	header.Set(ProfileHeader, "race")
+	header.Set(ResourceNameHeader, "time")
+	header.Set(BuildMetadata["BUILD_TEAM_NAME"], "main")
+	header.Set(BuildMetadata["BUILD_PIPELINE_NAME"], "release")
+
+	return header
+}
+
+// tampered returns hex with its first digit changed.
+func tampered(hex string) string {
+	if hex[0] == '0' {
+		return "1" + hex[1:]
+	}
+
+	return "0" + hex[1:]
+}
+
+func TestSignatureVerify(t *testing.T) {
+	header := handshakeHeader()
+	signature, err := NewSignature("s3cret", "check", header)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		secret    string
+		operation string
+		header    func(http.Header)
+		signature func(Signature) Signature
+		want      bool
+	}{
+		{name: "as signed", want: true},
+		{name: "other secret", secret: "guessed"},
+		{name: "other operation", operation: "out"},
+		{name: "changed ref", header: func(h http.Header) { h.Set(RefHeader, "evil") }},
+		{name: "dropped profile", header: func(h http.Header) { h.Del(ProfileHeader) }},
+		{name: "added debug", header: func(h http.Header) { h.Set(DebugHeader, "true") }},
+		{name: "changed pipeline", header: func(h http.Header) { h.Set(BuildMetadata["BUILD_PIPELINE_NAME"], "other") }},
+		{name: "asked for encryption", header: func(h http.Header) { h.Set(EncryptionHeader, EncryptionScheme) }},
+		{name: "unsigned header", header: func(h http.Header) { h.Set("User-Agent", "curl") }, want: true},
+		{name: "tampered MAC", signature: func(s Signature) Signature { s.MAC = tampered(s.MAC); return s }},
+		{name: "other timestamp", signature: func(s Signature) Signature { s.Timestamp++; return s }},
+		{name: "other nonce", signature: func(s Signature) Signature { s.Nonce = tampered(s.Nonce); return s }},
+		{name: "server proof instead", signature: func(s Signature) Signature { s.MAC = s.ServerProof("s3cret", "check", header); return s }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			secret, operation, h, s := "s3cret", "check", header.Clone(), signature
+
+			if test.secret != "" {
+				secret = test.secret
+			}
+
+			if test.operation != "" {
+				operation = test.operation
+			}
+
+			if test.header != nil {
+				test.header(h)
+			}
+
+			if test.signature != nil {
+				s = test.signature(s)
+			}
+
+			if got := s.Verify(secret, operation, h); got != test.want {
+				t.Errorf("Verify() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSignatureVerifyServerProof(t *testing.T) {
+	header := handshakeHeader()
+	signature, err := NewSignature("s3cret", "in", header)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed := header.Clone()
+	changed.Set(RefHeader, "evil")
+
+	proof := signature.ServerProof("s3cret", "in", header)
+
+	tests := []struct {
+		name      string
+		secret    string
+		operation string
+		header    http.Header
+		proof     string
+		want      bool
+	}{
+		{name: "as answered", secret: "s3cret", operation: "in", header: header, proof: proof, want: true},
+		{name: "other secret", secret: "s3cret", operation: "in", header: header, proof: signature.ServerProof("guessed", "in", header)},
+		{name: "other operation", secret: "s3cret", operation: "in", header: header, proof: signature.ServerProof("s3cret", "out", header)},
+		{name: "other header", secret: "s3cret", operation: "in", header: changed, proof: proof},
+		{name: "echoed signature", secret: "s3cret", operation: "in", header: header, proof: signature.MAC},
+		{name: "tampered proof", secret: "s3cret", operation: "in", header: header, proof: tampered(proof)},
+		{name: "missing proof", secret: "s3cret", operation: "in", header: header},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := signature.VerifyServerProof(test.secret, test.operation, test.header, test.proof); got != test.want {
+				t.Errorf("VerifyServerProof() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseSignature(t *testing.T) {
+	signature, err := NewSignature("s3cret", "out", http.Header{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		want   bool
+	}{
+		{name: "as formatted", header: signature.String(), want: true},
+		{name: "token", header: "s3cret"},
+		{name: "other scheme", header: "Bearer s3cret"},
+		{name: "missing MAC", header: "Signature timestamp=1, nonce=ab"},
+		{name: "invalid timestamp", header: "Signature timestamp=now, nonce=ab, mac=cd"},
+		{name: "missing value", header: "Signature timestamp=1, nonce, mac=cd"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parsed, ok := ParseSignature(test.header)
+
+			if ok != test.want {
+				t.Fatalf("ParseSignature() ok = %v, want %v", ok, test.want)
+			}
+
+			if ok && parsed != signature {
+				t.Errorf("ParseSignature() = %v, want %v", parsed, signature)
+			}
+		})
+	}
+}
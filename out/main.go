@@ -2,13 +2,9 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
 	"log"
-	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
-	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -16,11 +12,7 @@ import (
 )
 
 type OutRequest struct {
-	Source struct {
-		URL     string
-		Token   string
-		Proxied json.RawMessage `json:"proxied"`
-	} `json:"source"`
+	Source models.Source     `json:"source"`
 	Params map[string]string `json:"params"`
 }
 
@@ -50,51 +42,24 @@ func main() {
 		log.Fatal(err)
 	}
 
-	url, err := url.Parse(request.Source.URL)
-
-	if err != nil {
-		log.Fatal("parse:", err)
+	if err := models.RedactLog(request.Source); err != nil {
+		log.Fatalf("Error: %s", err)
 	}
 
-	if !(url.Scheme == "ws" || url.Scheme == "wss") {
-		log.Fatal("Error: uri scheme must be ws or wss")
-	}
-
-	if !strings.HasSuffix(url.Path, "/") {
-		url.Path = url.Path + "/"
-	}
-
-	url.Path = url.Path + "out"
-
-	log.Printf("proxying out to %s: ", url.String())
-
-	ws, response, err := websocket.DefaultDialer.Dial(url.String(), http.Header{
-		"Authorization": []string{request.Source.Token},
-	})
+	ws, err := models.Dial(request.Source, "out")
 
 	if err != nil {
-		log.Fatalf("Could not connect: %s (error %v)", err, response.Status)
+		log.Fatalf("Error: %s", err)
 	}
 
 	defer ws.Close()
 
 	done := make(chan struct{})
+	var exitStatus int
 
 	go func() {
 		defer close(done)
-		for {
-			messageType, message, err := ws.ReadMessage()
-
-			if err != nil {
-				if messageType != -1 { // noFrame
-					log.Printf("Error: %s", err)
-				}
-				return
-			}
-
-			log.Printf("O< %s", message)
-			fmt.Println(string(message))
-		}
+		exitStatus = models.Receive(ws, "", "O")
 	}()
 
 	models.SendFiles(ws, sourceDirectory)
@@ -119,6 +84,12 @@ func main() {
 	for {
 		select {
 		case <-done:
+			if exitStatus != 0 {
+				log.Printf("Error: resource exited with status %d", exitStatus)
+				ws.Close()
+				os.Exit(exitStatus)
+			}
+
 			return
 		case <-interrupt:
 			log.Println("interrupt")
@@ -0,0 +1,71 @@
+// Package profiling lets a resource write CPU and heap profiles when the
+// resource server asks for them with --pprof:
+//
+//	func main() {
+//		defer profiling.Start()()
+//		...
+//	}
+//
+// Without the environment variables set by the server, it does nothing.
+package profiling
+
+import (
+	"log"
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// Environment variables with the paths to write the profiles to
+const (
+	CPUProfileVariable  = "CONCOURSE_RESOURCE_CPU_PROFILE"
+	HeapProfileVariable = "CONCOURSE_RESOURCE_HEAP_PROFILE"
+)
+
+// Start starts CPU profiling if requested. The returned function stops it and
+// writes the heap profile if requested. Profiling errors are logged only, so
+// that they do not get in the way of the resource.
+func Start() func() {
+	var cpu *os.File
+
+	if path := os.Getenv(CPUProfileVariable); path != "" {
+		var err error
+		cpu, err = os.Create(path)
+
+		if err != nil {
+			log.Printf("could not create CPU profile: %s", err)
+		} else if err := pprof.StartCPUProfile(cpu); err != nil {
+			log.Printf("could not start CPU profile: %s", err)
+			cpu.Close()
+			cpu = nil
+		}
+	}
+
+	return func() {
+		if cpu != nil {
+			pprof.StopCPUProfile()
+			cpu.Close()
+		}
+
+		if path := os.Getenv(HeapProfileVariable); path != "" {
+			writeHeapProfile(path)
+		}
+	}
+}
+
+func writeHeapProfile(path string) {
+	f, err := os.Create(path)
+
+	if err != nil {
+		log.Printf("could not create heap profile: %s", err)
+		return
+	}
+
+	defer f.Close()
+
+	runtime.GC() // up-to-date statistics
+
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		log.Printf("could not write heap profile: %s", err)
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/suhlig/concourse-resource-proxy/models"
+)
+
+// audit appends a record of each session to a file of JSON lines. The file is
+// rotated to path.1, path.2 and so on when it grows too large.
+type audit struct {
+	path    string
+	maxSize int64 // in bytes; never rotated if zero
+	keep    int   // number of rotated files
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+
+	digests map[string]executableDigest // by path
+}
+
+// executableDigest is remembered until the executable changes.
+type executableDigest struct {
+	modified time.Time
+	size     int64
+	digest   string
+}
+
+// auditRecord tells who asked for what, and what came of it.
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	Address   string    `json:"address"`
+	Identity  string    `json:"identity,omitempty"` // empty if authentication failed
+	Team      string    `json:"team,omitempty"`
+	Pipeline  string    `json:"pipeline,omitempty"`
+	Job       string    `json:"job,omitempty"`
+	Build     string    `json:"build,omitempty"`
+	Resource  string    `json:"resource,omitempty"`
+	Operation string    `json:"operation"`
+
+	Encrypted        bool   `json:"encrypted,omitempty"`
+	RequestDigest    string `json:"request_sha256,omitempty"`
+	Executable       string `json:"executable,omitempty"`
+	ExecutableDigest string `json:"executable_sha256,omitempty"`
+
+	ExitStatus *int     `json:"exit_status,omitempty"`
+	Received   int64    `json:"bytes_received"`
+	Sent       int64    `json:"bytes_sent"`
+	Duration   duration `json:"duration"`
+	Error      string   `json:"error,omitempty"` // why the session was rejected or failed
+
+	conn *countingConn
+}
+
+func newAudit(path string, maxSize int64, keep int) (*audit, error) {
+	a := &audit{path: path, maxSize: maxSize, keep: keep, digests: make(map[string]executableDigest)}
+
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *audit) open() error {
+	file, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	a.file, a.size = file, info.Size()
+
+	return nil
+}
+
+// begin starts the record of the session that r asks for. Its traffic is
+// counted if w is used for the upgrade from now on.
+func (a *audit) begin(operation string, r *http.Request, address string, w http.ResponseWriter) (*auditRecord, http.ResponseWriter) {
+	record := &auditRecord{
+		Time:      time.Now().UTC(),
+		Address:   address,
+		Team:      r.Header.Get(models.BuildMetadata["BUILD_TEAM_NAME"]),
+		Pipeline:  r.Header.Get(models.BuildMetadata["BUILD_PIPELINE_NAME"]),
+		Job:       r.Header.Get(models.BuildMetadata["BUILD_JOB_NAME"]),
+		Build:     r.Header.Get(models.BuildMetadata["BUILD_NAME"]),
+		Resource:  r.Header.Get(models.ResourceNameHeader),
+		Operation: operation,
+		conn:      &countingConn{},
+	}
+
+	return record, &countingResponseWriter{ResponseWriter: w, conn: record.conn}
+}
+
+// executable adds the path and digest of cmd to record.
+func (a *audit) executable(record *auditRecord, cmd *command) {
+	record.Executable = cmd.path
+
+	info, err := os.Stat(cmd.path)
+
+	if err != nil {
+		log.Printf("audit: %s", err)
+		return
+	}
+
+	a.mu.Lock()
+	cached, ok := a.digests[cmd.path]
+	a.mu.Unlock()
+
+	if ok && cached.modified.Equal(info.ModTime()) && cached.size == info.Size() {
+		record.ExecutableDigest = cached.digest
+		return
+	}
+
+	digest, err := fileDigest(cmd.path)
+
+	if err != nil {
+		log.Printf("audit: %s", err)
+		return
+	}
+
+	a.mu.Lock()
+	a.digests[cmd.path] = executableDigest{modified: info.ModTime(), size: info.Size(), digest: digest}
+	a.mu.Unlock()
+
+	record.ExecutableDigest = digest
+}
+
+// write appends record to the log.
+func (a *audit) write(record *auditRecord) {
+	record.Duration = duration(time.Since(record.Time))
+	record.Received = atomic.LoadInt64(&record.conn.received)
+	record.Sent = atomic.LoadInt64(&record.conn.sent)
+
+	line, err := json.Marshal(record)
+
+	if err != nil {
+		log.Printf("audit: %s", err)
+		return
+	}
+
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			log.Printf("audit: could not rotate %s: %s", a.path, err)
+		}
+	}
+
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+
+	if err == nil {
+		err = a.file.Sync()
+	}
+
+	if err != nil {
+		log.Printf("audit: could not write to %s: %s", a.path, err)
+	}
+}
+
+// rotate moves the log to path.1, path.1 to path.2 and so on, dropping the
+// oldest, and starts a new one.
+func (a *audit) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+
+	if a.keep == 0 {
+		if err := os.Remove(a.path); err != nil {
+			return err
+		}
+	} else {
+		os.Remove(rotatedName(a.path, a.keep))
+
+		for i := a.keep - 1; i >= 1; i-- {
+			if err := os.Rename(rotatedName(a.path, i), rotatedName(a.path, i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+
+		if err := os.Rename(a.path, rotatedName(a.path, 1)); err != nil {
+			return err
+		}
+	}
+
+	return a.open()
+}
+
+func rotatedName(path string, i int) string {
+	return path + "." + strconv.Itoa(i)
+}
+
+func fileDigest(path string) (string, error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer file.Close()
+
+	h := sha256.New()
+
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func digest(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// countingResponseWriter hands out a countingConn when the connection is taken
+// over for the websocket.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	conn *countingConn
+}
+
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+
+	if !ok {
+		return nil, nil, errors.New("connection cannot be taken over")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w.conn.Conn = conn
+
+	return w.conn, rw, nil
+}
+
+// countingConn counts the bytes received and sent over the websocket, including
+// the framing.
+type countingConn struct {
+	net.Conn
+	received int64
+	sent     int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.received, int64(n))
+
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.sent, int64(n))
+
+	return n, err
+}
+
+// runAudit is the audit command. It prints the records of the log, including
+// the rotated files, that match the given criteria.
+func runAudit(args []string) {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	path := flags.String("log", "", "audit log `file` written with --audit")
+	since := flags.String("since", "", "only print sessions that started at or after this `time` (RFC 3339, or a duration like 24h before now)")
+	until := flags.String("until", "", "only print sessions that started before this `time` (RFC 3339, or a duration like 1h before now)")
+	operation := flags.String("operation", "", "only print sessions of this `operation` (check, in or out)")
+	flags.Parse(args)
+
+	if *path == "" {
+		log.Fatal("Error: --log is required")
+	}
+
+	from, err := parseAuditTime(*since)
+
+	if err != nil {
+		log.Fatalf("Error: --since: %s", err)
+	}
+
+	to, err := parseAuditTime(*until)
+
+	if err != nil {
+		log.Fatalf("Error: --until: %s", err)
+	}
+
+	// oldest first
+	var files []string
+
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotatedName(*path, i)); err != nil {
+			break
+		}
+
+		files = append([]string{rotatedName(*path, i)}, files...)
+	}
+
+	files = append(files, *path)
+
+	for _, name := range files {
+		file, err := os.Open(name)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(nil, 1024*1024)
+
+		for scanner.Scan() {
+			var record auditRecord
+
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				log.Printf("%s: skipping malformed line: %s", name, err)
+				continue
+			}
+
+			if (*operation != "" && record.Operation != *operation) ||
+				(!from.IsZero() && record.Time.Before(from)) ||
+				(!to.IsZero() && !record.Time.Before(to)) {
+				continue
+			}
+
+			fmt.Println(scanner.Text())
+		}
+
+		if err := scanner.Err(); err != nil {
+			log.Fatalf("%s: %s", name, err)
+		}
+
+		file.Close()
+	}
+}
+
+// parseAuditTime reads an RFC 3339 time, or a duration before now. It returns
+// the zero time for an empty string.
+func parseAuditTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/suhlig/concourse-resource-proxy/models"
+)
+
+// accepted are the tokens that clients authenticate with; nil if they use
+// client certificates.
+var accepted *tokens
+
+// clientCAs verify the certificates that clients authenticate with instead of
+// the token; nil if not enabled.
+var clientCAs *x509.CertPool
+
+// authenticate returns the identity of the client that sent r for operation,
+// or false if the client could not be authenticated. The proof of the server
+// for a signed handshake goes into responseHeader. If the client asked for
+// encryption with a signed handshake, the session is to be encrypted as
+// returned; otherwise, the returned encryption is nil.
+func authenticate(r *http.Request, operation string, responseHeader http.Header) (string, *models.Encryption, bool) {
+	if clientCAs != nil {
+		// verified during the TLS handshake already
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			return "", nil, false
+		}
+
+		return certificateIdentity(r.TLS.VerifiedChains[0][0]), nil, true
+	}
+
+	authorization := r.Header.Get("Authorization")
+
+	if signature, ok := models.ParseSignature(authorization); ok {
+		return verifySignature(signature, operation, r.Header, responseHeader)
+	}
+
+	if *requireSignatures {
+		return "", nil, false
+	}
+
+	identity, ok := accepted.check(authorization)
+
+	return identity, nil, ok
+}
+
+// verifySignature checks that signature is recent, made with one of the tokens
+// for header and not used before.
+func verifySignature(signature models.Signature, operation string, header, responseHeader http.Header) (string, *models.Encryption, bool) {
+	skew := time.Since(time.Unix(signature.Timestamp, 0))
+
+	if skew > models.MaxClockSkew || skew < -models.MaxClockSkew {
+		log.Printf("rejecting signature that is off by %s", skew)
+		return "", nil, false
+	}
+
+	entry, ok := accepted.verify(signature, operation, header)
+
+	if !ok {
+		return "", nil, false
+	}
+
+	if !usedNonces.use(signature.Nonce) {
+		log.Printf("rejecting replayed signature with token %s", entry.Name)
+		return "", nil, false
+	}
+
+	responseHeader.Set(models.ServerSignatureHeader, signature.ServerProof(entry.Token, operation, header))
+
+	if header.Get(models.EncryptionHeader) == "" {
+		return entry.Name, nil, true
+	}
+
+	serverNonce, err := models.NewNonce()
+
+	if err != nil {
+		log.Printf("could not create nonce: %s", err)
+		return "", nil, false
+	}
+
+	responseHeader.Set(models.EncryptionHeader, serverNonce)
+
+	return entry.Name, &models.Encryption{
+		Secret:      entry.Token,
+		Operation:   operation,
+		Signature:   signature,
+		ServerNonce: serverNonce,
+	}, true
+}
+
+// usedNonces are those of the signatures accepted recently.
+var usedNonces = &nonces{used: make(map[string]time.Time)}
+
+// nonces remembers nonces for as long as their signatures are accepted.
+type nonces struct {
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+// use returns false if nonce was used already.
+func (n *nonces) use(nonce string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for used, at := range n.used {
+		// the signature would be rejected by now anyway
+		if time.Since(at) > 2*models.MaxClockSkew {
+			delete(n.used, used)
+		}
+	}
+
+	if _, ok := n.used[nonce]; ok {
+		return false
+	}
+
+	n.used[nonce] = time.Now()
+
+	return true
+}
+
+// unauthorized tells the client that it could not be authenticated.
+func unauthorized(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusUnauthorized)
+
+	if clientCAs != nil {
+		w.Write([]byte("No or wrong client certificate"))
+	} else if *requireSignatures {
+		w.Write([]byte("No or wrong signature"))
+	} else {
+		w.Write([]byte("No or wrong auth token"))
+	}
+}
+
+// certificateIdentity maps the subject of a client certificate to the identity
+// of the client: its common name, or the whole subject if there is none.
+func certificateIdentity(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+
+	return cert.Subject.String()
+}
+
+// loadCertPool reads the PEM-encoded certificates in path.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	content, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, errors.New(path + " does not contain a PEM-encoded certificate")
+	}
+
+	return pool, nil
+}
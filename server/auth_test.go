@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/suhlig/concourse-resource-proxy/models"
+)
+
+func TestVerifySignature(t *testing.T) {
+	setUpRedaction("")
+
+	var err error
+	accepted, err = newTokens("s3cret", "")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(secret string, age time.Duration) models.Signature {
+		s, err := models.NewSignature(secret, "check", http.Header{})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.Timestamp = time.Now().Add(-age).Unix()
+
+		return s.Signed(secret, "check", http.Header{})
+	}
+
+	replayed := sign("s3cret", 0)
+
+	tests := []struct {
+		name      string
+		signature models.Signature
+		want      bool
+	}{
+		{name: "recent", signature: sign("s3cret", 0), want: true},
+		{name: "other token", signature: sign("guessed", 0)},
+		{name: "within the skew", signature: sign("s3cret", models.MaxClockSkew-time.Minute), want: true},
+		{name: "ahead within the skew", signature: sign("s3cret", -models.MaxClockSkew+time.Minute), want: true},
+		{name: "too old", signature: sign("s3cret", models.MaxClockSkew+time.Minute)},
+		{name: "too far ahead", signature: sign("s3cret", -models.MaxClockSkew-time.Minute)},
+		{name: "first use", signature: replayed, want: true},
+		{name: "replayed", signature: replayed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			responseHeader := http.Header{}
+			identity, _, ok := verifySignature(test.signature, "check", http.Header{}, responseHeader)
+
+			if ok != test.want {
+				t.Fatalf("verifySignature() ok = %v, want %v", ok, test.want)
+			}
+
+			if !ok {
+				return
+			}
+
+			if identity != "token" {
+				t.Errorf("verifySignature() identity = %q, want %q", identity, "token")
+			}
+
+			if !test.signature.VerifyServerProof("s3cret", "check", http.Header{}, responseHeader.Get(models.ServerSignatureHeader)) {
+				t.Error("verifySignature() did not answer with the server's proof")
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+
+	"github.com/suhlig/concourse-resource-proxy/models"
+)
+
+// authorization limits who may call which operation. A request is allowed if
+// any of the rules matches it.
+type authorization struct {
+	Rules []*authorizationRule `json:"rules"`
+}
+
+// authorizationRule allows the callers that match all of its lists. Entries are
+// patterns like release-*; an empty list matches any caller.
+type authorizationRule struct {
+	Operations []string `json:"operations"`
+	callerPatterns
+}
+
+// callerPatterns matches the callers that match all of its lists. Entries are
+// patterns like release-*; an empty list matches any caller.
+type callerPatterns struct {
+	Identities []string `json:"identities"` // token names or certificate subjects
+	Teams      []string `json:"teams"`
+	Pipelines  []string `json:"pipelines"`
+	Resources  []string `json:"resources"` // source.name as sent by the proxy
+}
+
+// claimsOnly tells whether p matches on what the proxy claims about itself,
+// without limiting the identity, which is the only thing the server
+// establishes. Anyone with a token can claim any team, pipeline or resource.
+func (p callerPatterns) claimsOnly() bool {
+	return len(p.Identities) == 0 && (len(p.Teams) > 0 || len(p.Pipelines) > 0 || len(p.Resources) > 0)
+}
+
+func (p callerPatterns) matches(c caller) bool {
+	return matchesAny(p.Identities, c.identity) &&
+		matchesAny(p.Teams, c.team) &&
+		matchesAny(p.Pipelines, c.pipeline) &&
+		matchesAny(p.Resources, c.resource)
+}
+
+// caller is who sent a request, as far as the server knows. Except for the
+// identity, this is what the proxy tells about itself.
+type caller struct {
+	identity string
+	team     string
+	pipeline string
+	resource string
+}
+
+func newCaller(identity string, r *http.Request) caller {
+	return caller{
+		identity: identity,
+		team:     r.Header.Get(models.BuildMetadata["BUILD_TEAM_NAME"]),
+		pipeline: r.Header.Get(models.BuildMetadata["BUILD_PIPELINE_NAME"]),
+		resource: r.Header.Get(models.ResourceNameHeader),
+	}
+}
+
+func (c caller) String() string {
+	unknown := func(s string) string {
+		if s == "" {
+			return "<unknown>"
+		}
+
+		return s
+	}
+
+	return fmt.Sprintf("%s (team %s, pipeline %s, resource %s)", c.identity, unknown(c.team), unknown(c.pipeline), unknown(c.resource))
+}
+
+func loadAuthorization(path string) (*authorization, error) {
+	var a authorization
+
+	if err := loadConfig(path, &a); err != nil {
+		return nil, fmt.Errorf("could not load authorization rules from %s: %w", path, err)
+	}
+
+	for i, rule := range a.Rules {
+		if rule.claimsOnly() {
+			log.Printf("Warning: authorization rule #%d in %s relies on the team, pipeline or resource that the proxy claims; limit it to identities, too", i+1, path)
+		}
+	}
+
+	return &a, nil
+}
+
+// allows tells whether c may call operation.
+func (a *authorization) allows(operation string, c caller) bool {
+	for _, rule := range a.Rules {
+		if matchesAny(rule.Operations, operation) && rule.matches(c) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchesAny tells whether value matches one of patterns, or patterns is empty.
+func matchesAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if matched, err := path.Match(pattern, value); err == nil && matched {
+			return true
+		}
+	}
+
+	return false
+}
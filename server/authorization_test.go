@@ -0,0 +1,70 @@
+package main
+
+import "testing"
+
+func TestAuthorizationAllows(t *testing.T) {
+	a := &authorization{Rules: []*authorizationRule{
+		{Operations: []string{"check", "in"}},
+		{
+			Operations: []string{"out"},
+			callerPatterns: callerPatterns{
+				Identities: []string{"ci"},
+				Teams:      []string{"main"},
+				Pipelines:  []string{"release-*"},
+			},
+		},
+	}}
+
+	release := caller{identity: "ci", team: "main", pipeline: "release-1.2", resource: "time"}
+
+	tests := []struct {
+		name      string
+		operation string
+		caller    caller
+		want      bool
+	}{
+		{name: "anyone may check", operation: "check", caller: caller{identity: "colleague"}, want: true},
+		{name: "anyone may get", operation: "in", caller: caller{identity: "colleague"}, want: true},
+		{name: "release pipeline may put", operation: "out", caller: release, want: true},
+		{name: "other identity", operation: "out", caller: caller{identity: "colleague", team: "main", pipeline: "release-1.2"}},
+		{name: "other team", operation: "out", caller: caller{identity: "ci", team: "other", pipeline: "release-1.2"}},
+		{name: "other pipeline", operation: "out", caller: caller{identity: "ci", team: "main", pipeline: "main"}},
+		{name: "unknown pipeline", operation: "out", caller: caller{identity: "ci", team: "main"}},
+		{name: "unknown operation", operation: "destroy", caller: release},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := a.allows(test.operation, test.caller); got != test.want {
+				t.Errorf("allows(%s, %s) = %v, want %v", test.operation, test.caller, got, test.want)
+			}
+		})
+	}
+
+	if (&authorization{}).allows("check", release) {
+		t.Error("allows() without rules = true, want false")
+	}
+}
+
+func TestCallerPatternsClaimsOnly(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns callerPatterns
+		want     bool
+	}{
+		{name: "anyone"},
+		{name: "identity", patterns: callerPatterns{Identities: []string{"ci"}}},
+		{name: "identity and team", patterns: callerPatterns{Identities: []string{"ci"}, Teams: []string{"main"}}},
+		{name: "team", patterns: callerPatterns{Teams: []string{"main"}}, want: true},
+		{name: "pipeline", patterns: callerPatterns{Pipelines: []string{"release"}}, want: true},
+		{name: "resource", patterns: callerPatterns{Resources: []string{"time"}}, want: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.patterns.claimsOnly(); got != test.want {
+				t.Errorf("claimsOnly() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// breakpoints pause each request in the server's terminal, so that the
+// developer can inspect and change it before it is served. The proxy keeps
+// waiting in the meantime.
+type breakpoints struct {
+	mu    sync.Mutex // one prompt at a time
+	input *bufio.Reader
+}
+
+// decision is what the developer chose at a breakpoint.
+type decision struct {
+	request []byte
+	cmd     *command
+
+	// hand-written; if not nil, the command is not run
+	response []byte
+}
+
+func newBreakpoints() *breakpoints {
+	return &breakpoints{input: bufio.NewReader(os.Stdin)}
+}
+
+// pause shows the request and the command that is about to serve it, and lets
+// the developer decide how to go on.
+func (b *breakpoints) pause(op *operation, request []byte, cmd *command) (*decision, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	d := &decision{request: request, cmd: cmd}
+
+	for {
+		var pretty bytes.Buffer
+
+		// only the terminal; the editor gets the secrets
+		redacted := redactor.Redact(d.request)
+
+		if json.Indent(&pretty, redacted, "", "  ") != nil {
+			pretty.Reset()
+			pretty.Write(redacted)
+		}
+
+		fmt.Fprintf(os.Stderr, "\n== %s: breakpoint for %s\n%s\n", op.marker, op.name, pretty.String())
+		fmt.Fprintf(os.Stderr, "command: %s\n", strings.Join(append([]string{d.cmd.path}, d.cmd.args...), " "))
+		fmt.Fprint(os.Stderr, "[a]pprove, [e]dit request, change [c]ommand or [r]espond yourself? ")
+
+		answer, err := b.readLine()
+
+		if err != nil {
+			return nil, err
+		}
+
+		switch answer {
+		case "a", "":
+			return d, nil
+		case "e":
+			var original bytes.Buffer
+
+			if json.Indent(&original, d.request, "", "  ") != nil {
+				original.Reset()
+				original.Write(d.request)
+			}
+
+			edited, err := editJSON(original.Bytes())
+
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				continue
+			}
+
+			d.request = edited
+		case "c":
+			fmt.Fprint(os.Stderr, "command: ")
+			line, err := b.readLine()
+
+			if err != nil {
+				return nil, err
+			}
+
+			fields := strings.Fields(line)
+
+			if len(fields) == 0 {
+				continue
+			}
+
+			program, err := exec.LookPath(fields[0])
+
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				continue
+			}
+
+			d.cmd = &command{path: program, args: fields[1:], env: d.cmd.env}
+		case "r":
+			template := []byte("{\n  \"version\": {},\n  \"metadata\": []\n}\n")
+
+			if op.name == "check" {
+				template = []byte("[\n  {}\n]\n")
+			}
+
+			response, err := editJSON(template)
+
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				continue
+			}
+
+			d.response = response
+
+			return d, nil
+		default:
+			fmt.Fprintf(os.Stderr, "unknown choice %q\n", answer)
+		}
+	}
+}
+
+func (b *breakpoints) readLine() (string, error) {
+	line, err := b.input.ReadString('\n')
+
+	if err != nil {
+		return "", fmt.Errorf("reading from terminal: %w", err)
+	}
+
+	return strings.TrimSpace(line), nil
+}
+
+// editJSON lets the developer edit content in $EDITOR and returns the result as
+// compact JSON.
+func editJSON(content []byte) ([]byte, error) {
+	f, err := os.CreateTemp("", "concourse-resource-proxy-server-*.json")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	f.Close()
+
+	editor := os.Getenv("EDITOR")
+
+	if editor == "" {
+		editor = "vi"
+	}
+
+	// let the shell split e.g. "code --wait"
+	cmd := exec.Command("sh", "-c", editor+` "$1"`, "sh", f.Name())
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w", editor, err)
+	}
+
+	edited, err := os.ReadFile(f.Name())
+
+	if err != nil {
+		return nil, err
+	}
+
+	var compacted bytes.Buffer
+
+	if err := json.Compact(&compacted, edited); err != nil {
+		return nil, fmt.Errorf("not valid JSON: %w", err)
+	}
+
+	return compacted.Bytes(), nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// goPackage is an executable that is built from Go sources whenever they changed.
+type goPackage struct {
+	dir    string // package directory
+	binary string // build output in the cache directory
+
+	mu          sync.Mutex
+	fingerprint string // of the sources binary was built from
+}
+
+// BuildError carries the output of a failed `go build`.
+type BuildError struct {
+	Package string
+	Output  string
+}
+
+func (e BuildError) Error() string {
+	return fmt.Sprintf("could not build %s:\n%s", e.Package, e.Output)
+}
+
+func newGoPackage(name, dir string) (*goPackage, error) {
+	dir, err := filepath.Abs(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !isGoPackage(dir) {
+		return nil, fmt.Errorf("%s is not a directory with Go sources", dir)
+	}
+
+	cacheDir := *buildCache
+
+	if cacheDir == "" {
+		cacheDir, err = defaultCacheDir()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// packages of different resources must not overwrite each other's binary
+	return &goPackage{
+		dir:    dir,
+		binary: filepath.Join(cacheDir, fmt.Sprintf("%x", sha256.Sum256([]byte(dir)))[:12], name),
+	}, nil
+}
+
+// command builds the package unless the binary is up to date with the sources.
+func (p *goPackage) command() (*command, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fingerprint, err := sourceFingerprint(moduleRoot(p.dir))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if fingerprint == p.fingerprint {
+		return &command{path: p.binary}, nil
+	}
+
+	log.Printf("building %s", p.dir)
+
+	args := []string{"build", "-o", p.binary}
+
+	if *debugListen != "" {
+		// optimizations get in the way of stepping through the code
+		args = append(args, "-gcflags=all=-N -l")
+	}
+
+	if *coverageDir != "" {
+		args = append(args, "-cover")
+	}
+
+	cmd := exec.Command("go", append(args, ".")...)
+	cmd.Dir = p.dir
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Run(); err != nil {
+		if output.Len() == 0 {
+			return nil, err
+		}
+
+		return nil, BuildError{Package: p.dir, Output: strings.TrimSpace(output.String())}
+	}
+
+	log.Printf("built %s", p.binary)
+	p.fingerprint = fingerprint
+
+	return &command{path: p.binary}, nil
+}
+
+func defaultCacheDir() (string, error) {
+	userCacheDir, err := os.UserCacheDir()
+
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(userCacheDir, "concourse-resource-proxy"), nil
+}
+
+// moduleRoot returns the directory of the go.mod that dir belongs to, or dir
+// itself if there is none.
+func moduleRoot(dir string) string {
+	for candidate := dir; ; {
+		if _, err := os.Stat(filepath.Join(candidate, "go.mod")); err == nil {
+			return candidate
+		}
+
+		parent := filepath.Dir(candidate)
+
+		if parent == candidate {
+			return dir
+		}
+
+		candidate = parent
+	}
+}
+
+// sourceFingerprint summarizes name, size and modification time of all files
+// below root that affect a build.
+func sourceFingerprint(root string) (string, error) {
+	hash := sha256.New()
+
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() {
+			if path != root && strings.HasPrefix(entry.Name(), ".") {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if !(strings.HasSuffix(path, ".go") || entry.Name() == "go.mod" || entry.Name() == "go.sum") {
+			return nil
+		}
+
+		info, err := entry.Info()
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(hash, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+
+		return nil
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+func isGoPackage(dir string) bool {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.go"))
+
+	return err == nil && len(matches) > 0
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A cassette is a directory of recorded sessions, one subdirectory each:
+//
+//	<time>-<operation>/
+//	  session.json  operation, time, exit status and resource usage
+//	  request.json  as received from the proxy
+//	  stdout
+//	  stderr
+//	  files/        as returned by in, or as received for out
+//	  *.pprof       profiles written by the resource (with --pprof)
+type recording struct {
+	Operation  string    `json:"operation"`
+	Time       time.Time `json:"time"`
+	ExitStatus int       `json:"exit_status"`
+	Usage      *usage    `json:"usage,omitempty"`
+
+	dir     string
+	request []byte
+}
+
+// recorder writes each session to a cassette.
+type recorder struct {
+	dir string
+}
+
+func newRecorder(dir string) (*recorder, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	return &recorder{dir: dir}, nil
+}
+
+// record writes the session of operation to a new subdirectory of the cassette
+// and returns its path. directory holds the files of in or out.
+func (rec *recorder) record(operation string, request []byte, result *result, directory string) (string, error) {
+	now := time.Now().UTC()
+	dir := filepath.Join(rec.dir, sessionDirName(now, operation))
+
+	if err := os.Mkdir(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+
+	if err := writeSession(dir, operation, now, request, result); err != nil {
+		return "", err
+	}
+
+	if directory != "" {
+		if err := copyFiles(directory, filepath.Join(dir, "files")); err != nil {
+			return "", err
+		}
+	}
+
+	return dir, nil
+}
+
+// sessionDirName returns the name of the directory for the session of
+// operation that started at t.
+func sessionDirName(t time.Time, operation string) string {
+	return t.Format("20060102T150405.000000000Z") + "-" + operation
+}
+
+// writeSession writes everything about the session to dir, except for the
+// files of in or out.
+func writeSession(dir, operation string, t time.Time, request []byte, result *result) error {
+	session, err := json.MarshalIndent(recording{
+		Operation:  operation,
+		Time:       t,
+		ExitStatus: result.ExitStatus,
+		Usage:      result.usage,
+	}, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	for name, content := range map[string][]byte{
+		"session.json": session,
+		"request.json": redactor.Redact(request),
+		"stdout":       redactor.Redact(result.Stdout),
+		"stderr":       redactor.Redact(result.Stderr),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+			return err
+		}
+	}
+
+	if result.profiles != "" {
+		if err := copyFiles(result.profiles, dir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadCassette reads the sessions recorded in dir, oldest first.
+func loadCassette(dir string) ([]*recording, error) {
+	entries, err := os.ReadDir(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var recordings []*recording
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		r, err := loadRecording(filepath.Join(dir, entry.Name()))
+
+		if err != nil {
+			log.Printf("skipping %s: %s", entry.Name(), err)
+			continue
+		}
+
+		recordings = append(recordings, r)
+	}
+
+	sort.Slice(recordings, func(i, j int) bool { return recordings[i].Time.Before(recordings[j].Time) })
+
+	return recordings, nil
+}
+
+func loadRecording(dir string) (*recording, error) {
+	var r recording
+
+	session, err := os.ReadFile(filepath.Join(dir, "session.json"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(session, &r); err != nil {
+		return nil, err
+	}
+
+	r.request, err = os.ReadFile(filepath.Join(dir, "request.json"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	r.dir = dir
+
+	return &r, nil
+}
+
+// matches tells whether the recording is of operation with an equivalent request.
+func (r *recording) matches(operation string, request []byte) bool {
+	if r.Operation != operation {
+		return false
+	}
+
+	var recorded, incoming interface{}
+
+	if json.Unmarshal(r.request, &recorded) != nil || json.Unmarshal(request, &incoming) != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(recorded, incoming)
+}
+
+// filesDir is where the files of the recorded session are, if any.
+func (r *recording) filesDir() string {
+	return filepath.Join(r.dir, "files")
+}
+
+// newCassettePlayer returns the command that answers requests for operation
+// from the cassette in dir.
+func newCassettePlayer(operation, dir string) (*command, error) {
+	return self("cassette", "--dir", dir, "--redact", *redactPatterns, operation)
+}
+
+// runCassette is the cassette command. It reads the request from STDIN and
+// replays the latest recorded session with an equivalent request.
+func runCassette(args []string) {
+	flags := flag.NewFlagSet("cassette", flag.ExitOnError)
+	dir := flags.String("dir", "", "cassette `directory` with the recorded sessions")
+	flags.StringVar(redactPatterns, "redact", "", "comma-separated regular `expressions` of further JSON keys that were masked when recording")
+	flags.Parse(args)
+	setUpRedaction(*redactPatterns)
+
+	if flags.NArg() < 1 {
+		log.Fatal("Error: missing operation (check, in or out)")
+	}
+
+	operation := flags.Arg(0)
+
+	request, err := io.ReadAll(os.Stdin)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	recordings, err := loadCassette(*dir)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var match *recording
+
+	for _, r := range recordings {
+		// secrets were masked in the recording
+		if r.matches(operation, redactor.Redact(request)) {
+			match = r
+		}
+	}
+
+	if match == nil {
+		log.Fatalf("Error: no recorded %s session in %s matches %s", operation, *dir, strings.TrimSpace(string(request)))
+	}
+
+	log.Printf("replaying %s", match.dir)
+
+	if err := replayRecording(match, operation, flags.Arg(1)); err != nil {
+		log.Fatal(err)
+	}
+
+	os.Exit(match.ExitStatus)
+}
+
+// replayRecording writes what the resource wrote in the recorded session.
+func replayRecording(r *recording, operation, directory string) error {
+	for name, w := range map[string]io.Writer{"stderr": os.Stderr, "stdout": os.Stdout} {
+		content, err := os.ReadFile(filepath.Join(r.dir, name))
+
+		if err != nil {
+			return err
+		}
+
+		w.Write(content)
+	}
+
+	if operation != "in" {
+		return nil
+	}
+
+	if directory == "" {
+		return errors.New("missing parameter for the destination directory")
+	}
+
+	if _, err := os.Stat(r.filesDir()); os.IsNotExist(err) {
+		return nil
+	}
+
+	return copyFiles(r.filesDir(), directory)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// loadConfig reads the JSON or YAML file at path into v. YAML is converted to
+// JSON first, so that v only needs JSON tags.
+func loadConfig(path string, v interface{}) error {
+	content, err := os.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	switch filepath.Ext(path) {
+	case ".yml", ".yaml":
+		var document interface{}
+
+		if err := yaml.Unmarshal(content, &document); err != nil {
+			return err
+		}
+
+		content, err = json.Marshal(document)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return json.Unmarshal(content, v)
+}
+
+// duration is a time.Duration that reads from and writes to JSON strings like
+// "1m30s".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
+
+	if err != nil {
+		return err
+	}
+
+	*d = duration(parsed)
+
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
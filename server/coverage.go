@@ -0,0 +1,196 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/suhlig/concourse-resource-proxy/models"
+)
+
+// unknown stands in for build metadata that the proxy did not pass, e.g. for
+// check. It is no valid name in Concourse, so it cannot clash with one.
+const unknown = "-"
+
+// coverage keeps the coverage data written by instrumented builds of the
+// resource, in a directory per operation, team, pipeline and session.
+type coverage struct {
+	dir string
+}
+
+func newCoverage(dir string) (*coverage, error) {
+	dir, err := filepath.Abs(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &coverage{dir: dir}, os.MkdirAll(dir, 0755)
+}
+
+// session creates the directory for the coverage data of one session of
+// operation and returns the command with GOCOVERDIR pointing to it.
+func (c *coverage) session(operation string, r *http.Request, cmd *command) (*command, string, error) {
+	dir := filepath.Join(
+		c.dir,
+		operation,
+		metadataName(r, "BUILD_TEAM_NAME"),
+		metadataName(r, "BUILD_PIPELINE_NAME"),
+		time.Now().UTC().Format("20060102T150405.000000000Z"),
+	)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, "", err
+	}
+
+	return cmd.withEnv("GOCOVERDIR=" + dir), dir, nil
+}
+
+// metadataName returns the build metadata passed by the proxy as a directory
+// name.
+func metadataName(r *http.Request, variable string) string {
+	value := r.Header.Get(models.BuildMetadata[variable])
+
+	if value == "" || value == "." || value == ".." || strings.ContainsAny(value, `/\`) {
+		return unknown
+	}
+
+	return value
+}
+
+// runCoverage is the coverage command. It merges the coverage data collected
+// with --coverage and reports it by operation and by pipeline.
+func runCoverage(args []string) {
+	flags := flag.NewFlagSet("coverage", flag.ExitOnError)
+	dir := flags.String("coverage", "coverage", "`directory` with the coverage data collected with --coverage")
+	profile := flags.String("profile", "", "write all coverage data merged into this `file` for go tool cover")
+	flags.Parse(args)
+
+	operations, err := readDirNames(*dir)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var all []string
+
+	for _, operation := range operations {
+		sessions, pipelines, err := coverageSessions(filepath.Join(*dir, operation))
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if len(sessions) == 0 {
+			continue
+		}
+
+		all = append(all, sessions...)
+
+		fmt.Printf("%s, %d sessions:\n", operation, len(sessions))
+
+		if err := coveragePercent(sessions); err != nil {
+			log.Fatal(err)
+		}
+
+		var names []string
+
+		for name := range pipelines {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		for _, name := range names {
+			label := "pipeline " + name
+
+			if name == unknown+"/"+unknown {
+				label = "unknown pipelines"
+			}
+
+			fmt.Printf("%s of %s, %d sessions:\n", operation, label, len(pipelines[name]))
+
+			if err := coveragePercent(pipelines[name]); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	if len(all) == 0 {
+		log.Fatalf("Error: no coverage data found in %s", *dir)
+	}
+
+	if *profile != "" {
+		cmd := exec.Command("go", "tool", "covdata", "textfmt", "-i="+strings.Join(all, ","), "-o="+*profile)
+		cmd.Stderr = os.Stderr
+
+		if err := cmd.Run(); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("wrote %s; view it with go tool cover -html=%s", *profile, *profile)
+	}
+}
+
+// coverageSessions returns the session directories below the directory of an
+// operation that hold coverage data, also grouped by team/pipeline.
+func coverageSessions(dir string) ([]string, map[string][]string, error) {
+	sessions, err := filepath.Glob(filepath.Join(dir, "*", "*", "*"))
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var withData []string
+	pipelines := make(map[string][]string)
+
+	for _, session := range sessions {
+		if names, err := readDirNames(session); err != nil || len(names) == 0 {
+			continue
+		}
+
+		pipeline, err := filepath.Rel(dir, filepath.Dir(session))
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		withData = append(withData, session)
+		pipelines[filepath.ToSlash(pipeline)] = append(pipelines[filepath.ToSlash(pipeline)], session)
+	}
+
+	return withData, pipelines, nil
+}
+
+// coveragePercent prints the coverage per package that the sessions add up to.
+func coveragePercent(sessions []string) error {
+	cmd := exec.Command("go", "tool", "covdata", "percent", "-i="+strings.Join(sessions, ","))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
+
+// readDirNames returns the sorted names of the entries in dir.
+func readDirNames(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+
+	return names, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/suhlig/concourse-resource-proxy/models"
+)
+
+// Time allowed to read the next pong message from the proxy while a debugger
+// holds the session; stepping through the resource takes a while.
+const debugPongWait = 24 * time.Hour
+
+// debugger runs the resource under dlv, waiting for a client to attach.
+type debugger struct {
+	dlv    string // path to the delve executable
+	listen string // address for clients to connect to
+
+	// operations that run under the debugger even without the proxy asking for it
+	always map[string]bool
+
+	// the listen address can only serve one session at a time
+	busy chan struct{}
+}
+
+func newDebugger(listen, operations string) (*debugger, error) {
+	dlv, err := exec.LookPath("dlv")
+
+	if err != nil {
+		return nil, err
+	}
+
+	always := make(map[string]bool)
+
+	for _, name := range strings.Split(operations, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			always[name] = true
+		}
+	}
+
+	return &debugger{dlv: dlv, listen: listen, always: always, busy: make(chan struct{}, 1)}, nil
+}
+
+// wanted tells whether the request for operation is to be debugged.
+func (d *debugger) wanted(operation string, r *http.Request) bool {
+	return d.always[operation] || r.Header.Get(models.DebugHeader) == "true"
+}
+
+// acquire reserves the debugger for a session, as it serves one at a time. The
+// returned function frees it again.
+func (d *debugger) acquire() (func(), error) {
+	select {
+	case d.busy <- struct{}{}:
+		return func() { <-d.busy }, nil
+	default:
+		return nil, requestError{http.StatusConflict, "debugger busy; another session is being debugged"}
+	}
+}
+
+// attach returns the command to run cmd under the debugger, which must have
+// been acquired.
+func (d *debugger) attach(marker string, cmd *command) *command {
+	log.Printf("%s: waiting for a debugger to attach; run `dlv connect %s` and `continue` to start %s", marker, d.listen, cmd.path)
+
+	args := []string{"exec", "--headless", "--api-version=2", "--listen=" + d.listen, cmd.path}
+
+	if len(cmd.args) > 0 {
+		args = append(append(args, "--"), cmd.args...)
+	}
+
+	return &command{
+		path: d.dlv,
+		args: args,
+		env:  cmd.env,
+
+		// the announcement of dlv is not part of the resource's output
+		hidden: func(line []byte) bool {
+			if !bytes.HasPrefix(line, []byte("API server listening at: ")) {
+				return false
+			}
+
+			log.Printf("%s: %s", marker, line)
+
+			return true
+		},
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDebuggerAcquire(t *testing.T) {
+	d := &debugger{busy: make(chan struct{}, 1)}
+
+	release, err := d.acquire()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = d.acquire()
+
+	var busy requestError
+
+	if !errors.As(err, &busy) || busy.status != http.StatusConflict {
+		t.Fatalf("acquire() while busy = %v, want %d", err, http.StatusConflict)
+	}
+
+	release()
+
+	if _, err := d.acquire(); err != nil {
+		t.Errorf("acquire() after release = %v, want nil", err)
+	}
+}
+
+func TestDebuggerHidesItsAnnouncement(t *testing.T) {
+	d := &debugger{dlv: "dlv", listen: "localhost:2345"}
+	cmd := d.attach("T", &command{path: "check"})
+
+	output := "API server listening at: 127.0.0.1:2345\n[{\"ref\":\"1\"}]\n"
+
+	var collected []byte
+	var forwarded []string
+	done := make(chan struct{})
+
+	pumpLines(strings.NewReader(output), &collected, cmd.hidden, func(line []byte) {
+		forwarded = append(forwarded, string(line))
+	}, done)
+
+	if got, want := string(collected), "[{\"ref\":\"1\"}]\n"; got != want {
+		t.Errorf("collected %q, want %q", got, want)
+	}
+
+	if len(forwarded) != 1 || forwarded[0] != `[{"ref":"1"}]` {
+		t.Errorf("forwarded %q, want the resource's output only", forwarded)
+	}
+}
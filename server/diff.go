@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+)
+
+// divergence is how the results of two runs for the same request differ.
+type divergence struct {
+	Stdout     *change      `json:"stdout,omitempty"`
+	ExitStatus *change      `json:"exit_status,omitempty"`
+	Files      *fileChanges `json:"files,omitempty"`
+}
+
+type change struct {
+	Baseline  interface{} `json:"baseline"`
+	Candidate interface{} `json:"candidate"`
+}
+
+// fileChanges are relative paths of the files that differ between the trees.
+type fileChanges struct {
+	Added   []string `json:"added,omitempty"`   // only in the candidate
+	Removed []string `json:"removed,omitempty"` // only in the baseline
+	Changed []string `json:"changed,omitempty"`
+}
+
+// compare returns how candidate diverges from baseline, or nil if it does not.
+// STDOUT is compared as JSON if possible, so that formatting does not matter.
+func compare(baseline, candidate *result) *divergence {
+	var d divergence
+	diverged := false
+
+	if !sameOutput(baseline.Stdout, candidate.Stdout) {
+		d.Stdout = &change{outputValue(baseline.Stdout), outputValue(candidate.Stdout)}
+		diverged = true
+	}
+
+	if baseline.ExitStatus != candidate.ExitStatus {
+		d.ExitStatus = &change{baseline.ExitStatus, candidate.ExitStatus}
+		diverged = true
+	}
+
+	if files := compareFiles(baseline.Files, candidate.Files); files != nil {
+		d.Files = files
+		diverged = true
+	}
+
+	if !diverged {
+		return nil
+	}
+
+	return &d
+}
+
+func sameOutput(a, b []byte) bool {
+	var valueA, valueB interface{}
+
+	if json.Unmarshal(a, &valueA) == nil && json.Unmarshal(b, &valueB) == nil {
+		return reflect.DeepEqual(valueA, valueB)
+	}
+
+	return bytes.Equal(a, b)
+}
+
+// outputValue is output as JSON, or as string if it is not valid JSON.
+func outputValue(output []byte) interface{} {
+	var compacted bytes.Buffer
+
+	if json.Compact(&compacted, output) == nil {
+		return json.RawMessage(compacted.Bytes())
+	}
+
+	return string(output)
+}
+
+func compareFiles(baseline, candidate map[string]string) *fileChanges {
+	var changes fileChanges
+
+	for path, digest := range baseline {
+		other, ok := candidate[path]
+
+		if !ok {
+			changes.Removed = append(changes.Removed, path)
+		} else if other != digest {
+			changes.Changed = append(changes.Changed, path)
+		}
+	}
+
+	for path := range candidate {
+		if _, ok := baseline[path]; !ok {
+			changes.Added = append(changes.Added, path)
+		}
+	}
+
+	if len(changes.Added)+len(changes.Removed)+len(changes.Changed) == 0 {
+		return nil
+	}
+
+	sort.Strings(changes.Added)
+	sort.Strings(changes.Removed)
+	sort.Strings(changes.Changed)
+
+	return &changes
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Layouts in which resources conventionally keep their executables, relative to
+// the resource directory. The operation name is substituted for %[1]s.
+var layouts = []string{
+	"%[1]s/%[1]s",  // Go sources, built in place, e.g. check/check
+	"assets/%[1]s", // assets dir, e.g. assets/check
+	"%[1]s",        // /opt/resource style, e.g. check
+}
+
+// Layouts in which resources conventionally keep the Go packages of their
+// executables when building on request.
+var packageLayouts = []string{
+	"%[1]s",     // e.g. check
+	"cmd/%[1]s", // e.g. cmd/check
+}
+
+// discoverAll looks for the executables of all operations below resourceDir and
+// uses them unless the operation's path was given explicitly.
+func discoverAll(resourceDir string) {
+	for _, op := range []struct {
+		name string
+		path *string
+	}{
+		{"check", checkPath},
+		{"in", inPath},
+		{"out", outPath},
+	} {
+		if *op.path != "" {
+			log.Printf("using explicitly given %s at %s", op.name, *op.path)
+			continue
+		}
+
+		found, ok := discover(resourceDir, op.name)
+
+		if !ok {
+			log.Printf("no %s found below %s", op.name, resourceDir)
+			continue
+		}
+
+		log.Printf("found %s at %s", op.name, found)
+		*op.path = found
+	}
+}
+
+// discover returns the first executable (or Go package, if building) for the
+// operation below dir that matches one of the known layouts.
+func discover(dir, operation string) (string, bool) {
+	candidates, matches := layouts, isExecutable
+
+	if *build {
+		candidates, matches = packageLayouts, isGoPackage
+	}
+
+	for _, layout := range candidates {
+		candidate := filepath.Join(dir, fmt.Sprintf(layout, operation))
+
+		if matches(candidate) {
+			return candidate, true
+		}
+	}
+
+	return "", false
+}
+
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+
+	if err != nil {
+		return false
+	}
+
+	return info.Mode().IsRegular() && info.Mode().Perm()&0111 != 0
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// executable provides the command that implements an operation.
+type executable interface {
+	// command returns the command to invoke, preparing it first if necessary.
+	command() (*command, error)
+}
+
+// command is an executable that exists on disk already.
+type command struct {
+	path string
+	args []string // passed before the directory argument of in and out
+	env  []string // in addition to the server's environment
+
+	// tells the lines of STDOUT that are not the resource's, e.g. of a
+	// debugger; nil if all are
+	hidden func(line []byte) bool
+}
+
+func (c *command) command() (*command, error) {
+	return c, nil
+}
+
+// withEnv returns a copy of c with env added to its environment.
+func (c *command) withEnv(env ...string) *command {
+	return &command{path: c.path, args: c.args, env: append(append([]string{}, c.env...), env...), hidden: c.hidden}
+}
+
+// newExecutable returns the executable for the operation called name, as given
+// on the command line.
+func newExecutable(name, path string) (executable, error) {
+	if *build {
+		return newGoPackage(name, path)
+	}
+
+	program, err := exec.LookPath(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &command{path: program}, nil
+}
+
+// self returns the command that runs the server itself with args, e.g. for
+// built-in stubs.
+func self(args ...string) (*command, error) {
+	path, err := os.Executable()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &command{path: path, args: args}, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// result is what a command produced for a request.
+type result struct {
+	Stdout     []byte
+	Stderr     []byte
+	ExitStatus int
+
+	// digests of the files that in left in its directory, by relative path
+	Files map[string]string
+
+	state *os.ProcessState
+	usage *usage
+
+	// directory with the profiles written by the command, if any
+	profiles string
+}
+
+// execute runs cmd like Concourse would: request on STDIN, which is closed
+// afterwards, and directory (unless empty) as argument. Each line of STDOUT and
+// STDERR is passed to the corresponding function (if not nil) as soon as it is
+// written. When abort is closed before the command exits, the command is
+// interrupted.
+func execute(cmd *command, request []byte, directory string, stdout func([]byte) error, stderr func([]byte), abort <-chan struct{}) (*result, error) {
+	stdinReader, stdinWriter, err := os.Pipe()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer stdinReader.Close()
+	defer stdinWriter.Close()
+
+	stdoutReader, stdoutWriter, err := os.Pipe()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer stdoutReader.Close()
+	defer stdoutWriter.Close()
+
+	stderrReader, stderrWriter, err := os.Pipe()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer stderrReader.Close()
+	defer stderrWriter.Close()
+
+	args := append([]string{cmd.path}, cmd.args...)
+
+	if directory != "" {
+		args = append(args, directory)
+	}
+
+	started := time.Now()
+
+	// TODO Set received environment variables
+	proc, err := os.StartProcess(cmd.path, args, &os.ProcAttr{
+		Env:   append(os.Environ(), cmd.env...),
+		Files: []*os.File{stdinReader, stdoutWriter, stderrWriter},
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	stdinReader.Close()
+	stdoutWriter.Close()
+	stderrWriter.Close()
+
+	var result result
+
+	stdoutDone := make(chan struct{})
+	go pumpLines(stdoutReader, &result.Stdout, cmd.hidden, func(line []byte) {
+		if stdout != nil && stdout(line) != nil {
+			stdout = nil // keep draining, so that the command does not block
+		}
+	}, stdoutDone)
+
+	stderrDone := make(chan struct{})
+	go pumpLines(stderrReader, &result.Stderr, nil, stderr, stderrDone)
+
+	go func() {
+		stdinWriter.Write(append(request, '\n'))
+		stdinWriter.Close() // Some commands will exit when stdin is closed.
+	}()
+
+	exited := make(chan struct{})
+	var waitErr error
+
+	go func() {
+		result.state, waitErr = proc.Wait()
+		close(exited)
+	}()
+
+	select {
+	case <-exited:
+	case <-abort:
+		// Other commands need a bonk on the head.
+		if err := proc.Signal(os.Interrupt); err != nil {
+			log.Println("inter:", err)
+		}
+
+		select {
+		case <-exited:
+		case <-time.After(time.Second):
+			// A bigger bonk on the head.
+			if err := proc.Signal(os.Kill); err != nil {
+				log.Println("term:", err)
+			}
+
+			<-exited
+		}
+	}
+
+	if waitErr != nil {
+		return nil, waitErr
+	}
+
+	<-stdoutDone
+	<-stderrDone
+
+	result.ExitStatus = result.state.ExitCode()
+	result.usage = newUsage(time.Since(started), result.state)
+
+	return &result, nil
+}
+
+// respond forwards response as if a command had written it to STDOUT.
+func respond(response []byte, stdout func([]byte) error) (*result, error) {
+	if err := stdout(response); err != nil {
+		return nil, err
+	}
+
+	return &result{Stdout: append(response, '\n')}, nil
+}
+
+// pumpLines reads r line by line, passing each line to forward (if not nil) and
+// collecting all of them in collected, except for the hidden ones (if not nil).
+func pumpLines(r io.Reader, collected *[]byte, hidden func([]byte) bool, forward func([]byte), done chan struct{}) {
+	defer close(done)
+
+	var buffer bytes.Buffer
+	s := bufio.NewScanner(r)
+
+	for s.Scan() {
+		if hidden != nil && hidden(s.Bytes()) {
+			continue
+		}
+
+		buffer.Write(s.Bytes())
+		buffer.WriteByte('\n')
+
+		if forward != nil {
+			forward(s.Bytes())
+		}
+	}
+
+	if s.Err() != nil {
+		log.Println("scan:", s.Err())
+	}
+
+	*collected = buffer.Bytes()
+}
+
+// executeIsolated runs exe for operation without a proxy, in a temporary
+// directory of its own. For out, the files in directory are copied into it;
+// for in, the result includes the digests of the files written there.
+func executeIsolated(operation string, exe executable, request []byte, directory string) (*result, error) {
+	cmd, err := exe.command()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var isolatedDirectory string
+
+	if operation != "check" {
+		isolatedDirectory, err = os.MkdirTemp("", "concourse-resource-proxy-server-"+operation+"-*")
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer os.RemoveAll(isolatedDirectory)
+	}
+
+	if operation == "out" && directory != "" {
+		if err := copyFiles(directory, isolatedDirectory); err != nil {
+			return nil, err
+		}
+	}
+
+	r, err := execute(cmd, request, isolatedDirectory, nil, nil, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if operation == "in" {
+		r.Files, err = digestFiles(isolatedDirectory)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
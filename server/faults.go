@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/suhlig/concourse-resource-proxy/models"
+)
+
+// faults are rules for injecting faults into sessions, so that the behavior of
+// pipelines with a slow, flaky or broken resource can be tested.
+type faults struct {
+	Rules []*faultRule `json:"rules"`
+}
+
+// faultRule describes which sessions are affected and how.
+type faultRule struct {
+	// operation to match; any if empty
+	Operation string `json:"operation"`
+
+	// fields of the request to match, by dotted path, e.g. source.interval
+	Match map[string]interface{} `json:"match"`
+
+	// chance of a matching session to be affected; 1 if not given
+	Probability *float64 `json:"probability"`
+
+	// wait before the resource is run
+	Latency duration `json:"latency"`
+
+	// wait before each line of STDOUT
+	OutputLatency duration `json:"output_latency"`
+
+	// replaces the exit status of the resource
+	ExitStatus *int `json:"exit_status"`
+
+	// close the connection without further ado after this many lines of STDOUT
+	DropAfterLines *int `json:"drop_after_lines"`
+
+	// garble STDOUT
+	Corrupt bool `json:"corrupt"`
+
+	// cut off STDOUT after this many bytes
+	Truncate *int `json:"truncate"`
+
+	// let check return no versions at all, without running the resource
+	EmptyCheck bool `json:"empty_check"`
+}
+
+func loadFaults(path string) (*faults, error) {
+	var f faults
+
+	if err := loadConfig(path, &f); err != nil {
+		return nil, fmt.Errorf("could not load fault rules from %s: %w", path, err)
+	}
+
+	// sessions are not to be affected the same way on each start
+	rand.Seed(time.Now().UnixNano())
+
+	return &f, nil
+}
+
+// pick returns the first rule that matches the session and that is chosen by
+// chance, if any.
+func (f *faults) pick(operation string, request []byte) (int, *faultRule) {
+	var decoded interface{}
+	json.Unmarshal(request, &decoded)
+
+	for i, rule := range f.Rules {
+		if !rule.matches(operation, decoded) {
+			continue
+		}
+
+		if rule.Probability != nil && rand.Float64() >= *rule.Probability {
+			continue
+		}
+
+		return i, rule
+	}
+
+	return -1, nil
+}
+
+func (rule *faultRule) matches(operation string, request interface{}) bool {
+	if rule.Operation != "" && rule.Operation != operation {
+		return false
+	}
+
+	for path, expected := range rule.Match {
+		actual := request
+
+		for _, key := range strings.Split(path, ".") {
+			object, ok := actual.(map[string]interface{})
+
+			if !ok {
+				return false
+			}
+
+			actual = object[key]
+		}
+
+		if !reflect.DeepEqual(actual, expected) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// injection is a fault rule applied to one session.
+type injection struct {
+	rule *faultRule
+	ws   *models.Conn
+
+	lines   int
+	bytes   int
+	dropped bool
+}
+
+// delay waits for the latency of the rule.
+func (i *injection) delay() {
+	if i.rule.Latency > 0 {
+		time.Sleep(time.Duration(i.rule.Latency))
+	}
+}
+
+// forward wraps next with the faults of the rule that affect STDOUT.
+func (i *injection) forward(next func([]byte) error) func([]byte) error {
+	return func(line []byte) error {
+		if i.rule.DropAfterLines != nil && i.lines >= *i.rule.DropAfterLines {
+			i.drop()
+		}
+
+		if i.dropped {
+			return websocket.ErrCloseSent
+		}
+
+		i.lines++
+
+		if i.rule.OutputLatency > 0 {
+			time.Sleep(time.Duration(i.rule.OutputLatency))
+		}
+
+		if i.rule.Truncate != nil {
+			remaining := *i.rule.Truncate - i.bytes
+
+			if remaining <= 0 {
+				return nil
+			}
+
+			if len(line) > remaining {
+				line = line[:remaining]
+			}
+		}
+
+		i.bytes += len(line)
+
+		if i.rule.Corrupt {
+			line = corrupt(line)
+		}
+
+		return next(line)
+	}
+}
+
+// drop closes the network connection without a closing handshake, unless it
+// was dropped already.
+func (i *injection) drop() {
+	if i.dropped {
+		return
+	}
+
+	log.Printf("dropping the connection after %d lines", i.lines)
+	i.ws.UnderlyingConn().Close()
+	i.dropped = true
+}
+
+// corrupt replaces every tenth byte (on average) of line with garbage.
+func corrupt(line []byte) []byte {
+	garbled := make([]byte, len(line))
+	copy(garbled, line)
+
+	for j := range garbled {
+		if rand.Intn(10) == 0 {
+			garbled[j] = byte(' ' + rand.Intn('~'-' '))
+		}
+	}
+
+	return garbled
+}
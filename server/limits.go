@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limits protects the server from clients that guess tokens or open too many
+// sessions.
+type limits struct {
+	allowed []*net.IPNet // any address if empty
+
+	// taken from the last address in X-Forwarded-For, as appended by a tunnel or
+	// reverse proxy
+	trustForwardedFor bool
+
+	maxFailures   int // per address within failureWindow; no lockout if zero
+	failureWindow time.Duration
+	lockout       time.Duration
+
+	maxSessions            int // no limit if zero
+	maxSessionsPerIdentity int // no limit if zero
+
+	mu         sync.Mutex
+	failures   map[string][]time.Time // recent failed authentications by address
+	lockedOut  map[string]time.Time   // until when, by address
+	sessions   int
+	byIdentity map[string]int
+}
+
+// clientLimits apply to all requests.
+var clientLimits *limits
+
+func newLimits(allowFrom string) (*limits, error) {
+	l := &limits{
+		failures:   make(map[string][]time.Time),
+		lockedOut:  make(map[string]time.Time),
+		byIdentity: make(map[string]int),
+	}
+
+	for _, entry := range strings.Split(allowFrom, ",") {
+		entry = strings.TrimSpace(entry)
+
+		if entry == "" {
+			continue
+		}
+
+		// a single address
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+
+		if err != nil {
+			return nil, fmt.Errorf("--allow-from: %w", err)
+		}
+
+		l.allowed = append(l.allowed, network)
+	}
+
+	return l, nil
+}
+
+// address returns the address of the client that sent r.
+func (l *limits) address(r *http.Request) string {
+	if l.trustForwardedFor {
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			addresses := strings.Split(forwarded[len(forwarded)-1], ",")
+			return strings.TrimSpace(addresses[len(addresses)-1])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// admit checks whether the client at address may try to authenticate.
+func (l *limits) admit(address string) error {
+	if len(l.allowed) > 0 {
+		ip := net.ParseIP(address)
+		allowed := false
+
+		for _, network := range l.allowed {
+			if ip != nil && network.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			return requestError{http.StatusForbidden, address + " is not allowed to connect"}
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.forget(time.Now())
+
+	if until, ok := l.lockedOut[address]; ok {
+		return requestError{http.StatusTooManyRequests, fmt.Sprintf("%s is locked out until %s after repeated failed authentication", address, until.Format(time.RFC3339))}
+	}
+
+	return nil
+}
+
+// failed counts a failed authentication from address and locks it out if there
+// were too many recently.
+func (l *limits) failed(address string) {
+	if l.maxFailures == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.forget(now)
+
+	l.failures[address] = append(l.failures[address], now)
+
+	if len(l.failures[address]) >= l.maxFailures {
+		delete(l.failures, address)
+		l.lockedOut[address] = now.Add(l.lockout)
+		log.Printf("locking out %s for %s after %d failed authentications", address, l.lockout, l.maxFailures)
+	}
+}
+
+// forget drops the failed authentications that are too old to count and the
+// lockouts that have passed, for all addresses, so that neither grows with each
+// address ever seen. l.mu must be held.
+func (l *limits) forget(now time.Time) {
+	for address, times := range l.failures {
+		for len(times) > 0 && now.Sub(times[0]) > l.failureWindow {
+			times = times[1:]
+		}
+
+		if len(times) == 0 {
+			delete(l.failures, address)
+		} else {
+			l.failures[address] = times
+		}
+	}
+
+	for address, until := range l.lockedOut {
+		if !now.Before(until) {
+			delete(l.lockedOut, address)
+		}
+	}
+}
+
+// enter starts a session of identity unless there are too many already. The
+// returned function ends it.
+func (l *limits) enter(identity string) (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxSessions > 0 && l.sessions >= l.maxSessions {
+		return nil, requestError{http.StatusServiceUnavailable, fmt.Sprintf("too many concurrent sessions (%d)", l.sessions)}
+	}
+
+	if l.maxSessionsPerIdentity > 0 && l.byIdentity[identity] >= l.maxSessionsPerIdentity {
+		return nil, requestError{http.StatusServiceUnavailable, fmt.Sprintf("too many concurrent sessions of %s (%d)", identity, l.byIdentity[identity])}
+	}
+
+	l.sessions++
+	l.byIdentity[identity]++
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		l.sessions--
+		l.byIdentity[identity]--
+
+		if l.byIdentity[identity] == 0 {
+			delete(l.byIdentity, identity)
+		}
+	}, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimitsLockout(t *testing.T) {
+	l, err := newLimits("")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.maxFailures = 3
+	l.failureWindow = time.Minute
+	l.lockout = 50 * time.Millisecond
+
+	for i := 0; i < 2; i++ {
+		l.failed("192.0.2.1")
+	}
+
+	if err := l.admit("192.0.2.1"); err != nil {
+		t.Fatalf("admit() after 2 failures = %v, want nil", err)
+	}
+
+	l.failed("192.0.2.1")
+
+	if err := l.admit("192.0.2.1"); err == nil {
+		t.Fatal("admit() after 3 failures = nil, want lockout")
+	}
+
+	if err := l.admit("192.0.2.2"); err != nil {
+		t.Errorf("admit() of another address = %v, want nil", err)
+	}
+
+	time.Sleep(l.lockout)
+
+	if err := l.admit("192.0.2.1"); err != nil {
+		t.Errorf("admit() after the lockout = %v, want nil", err)
+	}
+}
+
+func TestLimitsForget(t *testing.T) {
+	l, err := newLimits("")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.failureWindow = time.Minute
+	now := time.Now()
+
+	l.failures = map[string][]time.Time{
+		"192.0.2.1": {now.Add(-2 * time.Minute)},
+		"192.0.2.2": {now.Add(-2 * time.Minute), now.Add(-10 * time.Second)},
+		"192.0.2.3": {now.Add(-10 * time.Second)},
+	}
+
+	l.lockedOut = map[string]time.Time{
+		"192.0.2.4": now.Add(-time.Second),
+		"192.0.2.5": now,
+		"192.0.2.6": now.Add(time.Minute),
+	}
+
+	l.forget(now)
+
+	if len(l.failures) != 2 || len(l.failures["192.0.2.2"]) != 1 || len(l.failures["192.0.2.3"]) != 1 {
+		t.Errorf("failures = %v, want the recent ones of 192.0.2.2 and 192.0.2.3 only", l.failures)
+	}
+
+	if _, ok := l.lockedOut["192.0.2.6"]; len(l.lockedOut) != 1 || !ok {
+		t.Errorf("lockedOut = %v, want 192.0.2.6 only", l.lockedOut)
+	}
+}
@@ -5,30 +5,77 @@
 package main
 
 import (
-	"bufio"
+	"crypto/tls"
 	"flag"
-	"io"
+	"fmt"
 	"log"
-	"math/rand"
 	"net/http"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/suhlig/concourse-resource-proxy/models"
+	"github.com/suhlig/concourse-resource-proxy/profiling"
 )
 
 var (
-	addr          = flag.String("addr", "127.0.0.1:8080", "http service address")
-	checkPath     = flag.String("check", "", "path to the `check` executable under test")
-	inPath        = flag.String("in", "", "path to the `in` executable under test")
-	outPath       = flag.String("out", "", "path to the `out` executable under test")
-	requiredToken = flag.String("token", randomToken(), "authentication token")
-	checkProgram  string
-	inProgram     string
-	outProgram    string
-	upgrader      = websocket.Upgrader{}
+	addr              = flag.String("addr", "127.0.0.1:8080", "http service address")
+	resourceDir       = flag.String("resource-dir", "", "`directory` to discover the check, in and out executables in; explicit paths take precedence")
+	checkPath         = flag.String("check", "", "path to the `check` executable under test")
+	inPath            = flag.String("in", "", "path to the `in` executable under test")
+	outPath           = flag.String("out", "", "path to the `out` executable under test")
+	build             = flag.Bool("build", false, "treat the check, in and out paths as Go packages and build them before a request whenever their sources changed")
+	buildCache        = flag.String("build-cache", "", "`directory` for the binaries built with --build (default is in the user's cache directory)")
+	repo              = flag.String("repo", "", "local git `repository` of the resource; enables serving the refs requested by the proxy")
+	worktreeDir       = flag.String("worktrees", "", "`directory` to check out the requested refs to (default is in the user's cache directory)")
+	profilesPath      = flag.String("profiles", "", "JSON or YAML `file` with named profiles of check, in and out commands that the proxy can choose from")
+	shadowDir         = flag.String("shadow", "", "resource `directory` of a candidate build that runs in addition to each request for comparison")
+	shadowOut         = flag.Bool("shadow-out", false, "also run the candidate's out, which puts a second time for each request")
+	shadowDiffs       = flag.String("shadow-diffs", "shadow-diffs.jsonl", "`file` to append the divergences of the candidate to")
+	stubCheck         = flag.String("stub-check", "", "serve check from a built-in stub returning the versions in this JSON template `file`")
+	stubCheckRotate   = flag.Bool("stub-check-rotate", false, "let the check stub return only the version following the requested one")
+	stubIn            = flag.String("stub-in", "", "serve in from a built-in stub copying this fixture `directory`")
+	stubOut           = flag.String("stub-out", "", "serve out from a built-in stub returning this JSON template `file`")
+	recordDir         = flag.String("record", "", "cassette `directory` to record each session to")
+	replayDir         = flag.String("replay", "", "cassette `directory` to answer requests from, for each of check, in and out that is not served otherwise")
+	keepDir           = flag.String("keep", "", "`directory` to keep the working directory of each session in, together with its request, output and exit status")
+	keepCount         = flag.Int("keep-count", 0, "keep only this `number` of the most recent sessions (default is all)")
+	keepAge           = flag.Duration("keep-age", 0, "remove kept sessions older than this `duration` (default is never)")
+	breakOnRequest    = flag.Bool("break", false, "pause each request in the terminal to inspect and change it before it is served")
+	faultsPath        = flag.String("faults", "", "JSON or YAML `file` with rules for injecting faults into matching sessions")
+	debugListen       = flag.String("debug", "", "`address` for dlv to listen on; enables running the resource under the debugger when the proxy asks for it")
+	debugOperations   = flag.String("debug-operations", "", "comma-separated `operations` that always run under the debugger")
+	coverageDir       = flag.String("coverage", "", "`directory` to keep the coverage data of instrumented builds in, per session")
+	pprof             = flag.Bool("pprof", false, "ask the resource for CPU and heap profiles of each session and add them to its recording or kept directory; requires --record or --keep")
+	tlsCert           = flag.String("tls-cert", "", "serve TLS with the certificate in this PEM `file`")
+	tlsKey            = flag.String("tls-key", "", "PEM `file` with the private key for --tls-cert")
+	tlsAuto           = flag.String("tls-auto", "", "serve TLS with a self-signed CA and server certificate that are generated into and kept in this `directory`")
+	clientCA          = flag.String("client-ca", "", "require client certificates signed by the CA in this PEM `file` instead of the token; requires TLS")
+	tlsHostNames      = flag.String("tls-hosts", "", "comma-separated `names` and addresses to generate the server certificate for with --tls-auto, in addition to the host of --addr and localhost")
+	auditPath         = flag.String("audit", "", "JSON lines `file` to append a record of each session to")
+	auditMaxSize      = flag.Int("audit-max-size", 100, "rotate the audit log when it grows beyond this many `megabytes` (0 disables rotation)")
+	auditKeep         = flag.Int("audit-keep", 10, "`number` of rotated audit logs to keep")
+	overlaysPath      = flag.String("overlays", "", "JSON or YAML `file` with overlays to merge into the source of matching requests, interpolating ((VARIABLE)) and ((file:path))")
+	redactPatterns    = flag.String("redact", "", "comma-separated regular `expressions` of further JSON keys whose values are masked in the log and in session files")
+	requiredToken     = flag.String("token", "", "authentication token (default is $"+tokenVariable+", or a new one printed to the terminal unless --tokens is given)")
+	requireEncryption = flag.Bool("require-encryption", false, "accept only proxies that encrypt the session; implies --require-signatures")
+	requireSignatures = flag.Bool("require-signatures", false, "accept only proxies that sign the handshake with their token instead of sending it")
+	authorizationPath = flag.String("authorization", "", "JSON or YAML `file` with rules on which identities, teams, pipelines and resources may call which operation")
+	allowFrom         = flag.String("allow-from", "", "comma-separated `addresses` and CIDR ranges to accept connections from (default is any)")
+	trustForwardedFor = flag.Bool("trust-x-forwarded-for", false, "take the client's address from the X-Forwarded-For header set by a tunnel or reverse proxy")
+	maxFailures       = flag.Int("max-failures", 5, "lock out an address after this `number` of failed authentications within --failure-window; requires --trust-x-forwarded-for or --allow-from (0 disables the lockout)")
+	failureWindow     = flag.Duration("failure-window", time.Minute, "`duration` within which failed authentications count towards --max-failures; requires --trust-x-forwarded-for or --allow-from")
+	lockout           = flag.Duration("lockout", 15*time.Minute, "`duration` of the lockout after too many failed authentications; requires --trust-x-forwarded-for or --allow-from")
+	maxSessions       = flag.Int("max-sessions", 0, "maximum `number` of concurrent sessions (default is no limit)")
+	maxSessionsPerID  = flag.Int("max-sessions-per-identity", 0, "maximum `number` of concurrent sessions per token or client certificate (default is no limit)")
+	tokensPath        = flag.String("tokens", "", "JSON or YAML `file` with named tokens to accept, reloaded on SIGHUP")
+
+	// with a read buffer of its own, all reads go through the connection that
+	// the audit counts
+	upgrader = websocket.Upgrader{ReadBufferSize: 4096}
 )
 
 const (
@@ -48,466 +95,476 @@ const (
 	closeGracePeriod = 10 * time.Second
 )
 
+// commands other than serving, by name of the first argument
+var commands = map[string]func(args []string){
+	"stub":        runStub,
+	"cassette":    runCassette,
+	"audit":       runAudit,
+	"replay":      runReplay,
+	"coverage":    runCoverage,
+	"client-cert": runClientCert,
+	"token":       runToken,
+}
+
 func main() {
 	log.SetFlags(0)
-	flag.Parse()
+	setUpRedaction("")
 
-	var err error
-	checkProgram, err = exec.LookPath(*checkPath)
-
-	if err != nil {
-		log.Fatal(err)
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
+		}
 	}
 
-	log.Printf("requiring token %s", *requiredToken)
+	flag.Parse()
+	setUpRedaction(*redactPatterns)
 
-	log.Printf("proxying /check to %s", checkProgram)
-	http.HandleFunc("/check", serveCheck)
+	if *resourceDir != "" {
+		discoverAll(*resourceDir)
+	}
 
-	inProgram, err = exec.LookPath(*inPath)
+	var err error
+	clientLimits, err = newLimits(*allowFrom)
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	log.Printf("proxying /in to %s", inProgram)
-	http.HandleFunc("/in", serveIn)
-
-	outProgram, err = exec.LookPath(*outPath)
+	clientLimits.trustForwardedFor = *trustForwardedFor
+	clientLimits.failureWindow = *failureWindow
+	clientLimits.lockout = *lockout
+	clientLimits.maxSessions = *maxSessions
+	clientLimits.maxSessionsPerIdentity = *maxSessionsPerID
+
+	// behind a tunnel, all clients would share its address and be locked out
+	// together
+	if *trustForwardedFor || *allowFrom != "" {
+		clientLimits.maxFailures = *maxFailures
+	} else if *maxFailures > 0 {
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "max-failures", "failure-window", "lockout":
+				log.Fatalf("Error: --%s has no effect without --trust-x-forwarded-for or --allow-from, as all clients of a tunnel share its address", f.Name)
+			}
+		})
 
-	if err != nil {
-		log.Fatal(err)
+		log.Print("not locking out addresses after failed authentications, as all clients of a tunnel share its address; enable with --trust-x-forwarded-for or --allow-from")
 	}
 
-	log.Printf("proxying /out to %s", outProgram)
-	http.HandleFunc("/out", serveOut)
+	if len(clientLimits.allowed) > 0 {
+		log.Printf("accepting connections from %s only", clientLimits.allowed)
+	}
 
-	log.Fatal(http.ListenAndServe(*addr, nil))
-}
+	if *clientCA != "" {
+		if *requiredToken != "" || *tokensPath != "" || *requireSignatures || *requireEncryption {
+			log.Fatal("Error: --client-ca cannot be combined with --token, --tokens, --require-signatures or --require-encryption")
+		}
 
-func pumpStdin(ws *websocket.Conn, stdin io.Writer, marker string) {
-	defer ws.Close()
-	ws.SetReadLimit(maxMessageSize)
-	ws.SetReadDeadline(time.Now().Add(pongWait))
-	ws.SetPongHandler(func(string) error { ws.SetReadDeadline(time.Now().Add(pongWait)); return nil })
-
-	for {
-		_, message, err := ws.ReadMessage()
+		var err error
+		clientCAs, err = loadCertPool(*clientCA)
 
 		if err != nil {
-			break
+			log.Fatal(err)
 		}
 
-		log.Printf("< %s\n", message)
+		log.Printf("requiring client certificates signed by %s", *clientCA)
+	} else {
+		fixed := *requiredToken
+
+		if fixed == "" {
+			fixed = os.Getenv(tokenVariable)
+		}
 
-		message = append(message, '\n')
+		if fixed == "" && *tokensPath == "" {
+			// a generated token would end up in whatever the log is written to
+			if !isTerminal(os.Stderr) {
+				log.Fatalf("Error: a token is required with --token, $%s or --tokens; generate one with the token command", tokenVariable)
+			}
 
-		if _, err := stdin.Write(message); err != nil {
-			break
+			fixed = randomToken()
+			// bypassing the redaction, as there is no other way to learn it
+			fmt.Fprintf(os.Stderr, "requiring the generated token %s\n", fixed)
 		}
-	}
-}
 
-func pumpStdout(stdout io.Reader, ws *websocket.Conn, done chan struct{}, resourceDirectory, marker string) {
-	defer func() {
-	}()
+		var err error
+		accepted, err = newTokens(fixed, *tokensPath)
 
-	s := bufio.NewScanner(stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	// forward lines on STDIN as websocket text message
-	for s.Scan() {
-		ws.SetWriteDeadline(time.Now().Add(writeWait))
-		message := s.Bytes()
+		log.Printf("accepting tokens %s", accepted)
 
-		log.Printf("%s> %s", marker, message)
+		if *tokensPath != "" {
+			go accepted.reloadOnHangup()
+		}
 
-		if err := ws.WriteMessage(websocket.TextMessage, message); err != nil {
-			log.Printf("E: %s", err)
-			ws.Close()
-			break
+		if *requireEncryption {
+			*requireSignatures = true
+			log.Printf("requiring signed handshakes and sessions encrypted with %s", models.EncryptionScheme)
+		} else if *requireSignatures {
+			log.Print("requiring signed handshakes")
 		}
 	}
 
-	if s.Err() != nil {
-		log.Println("scan:", s.Err())
-	}
+	var refs *worktrees
 
-	if !isClosed(done) {
-		close(done)
-	}
+	if *repo != "" {
+		var err error
+		refs, err = newWorktrees(*repo, *worktreeDir)
 
-	if resourceDirectory != "" {
-		models.SendFiles(ws, resourceDirectory)
-	}
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	ws.SetWriteDeadline(time.Now().Add(writeWait))
-	ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "done reading STDOUT"))
-	time.Sleep(closeGracePeriod)
-	ws.Close()
-}
+		log.Printf("serving refs requested by the proxy from worktrees of %s", refs.repo)
+	}
 
-func pumpStderr(r io.Reader, done chan struct{}) {
-	s := bufio.NewScanner(r)
-	for s.Scan() {
-		message := s.Bytes()
+	var selectable *profiles
 
-		log.Printf("E %s", message)
-	}
+	if *profilesPath != "" {
+		var err error
+		selectable, err = loadProfiles(*profilesPath)
 
-	if s.Err() != nil {
-		log.Println("scan:", s.Err())
-	}
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	close(done)
-}
+		var names []string
 
-func ping(ws *websocket.Conn, done chan struct{}) {
-	ticker := time.NewTicker(pingPeriod)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-ticker.C:
-			if err := ws.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeWait)); err != nil {
-				log.Println("ping:", err)
-			}
-		case <-done:
-			return
+		for name := range selectable.Profiles {
+			names = append(names, name)
 		}
-	}
-}
 
-func internalError(ws *websocket.Conn, msg string, err error) {
-	log.Println(msg, err)
-	ws.WriteMessage(websocket.TextMessage, []byte(msg))
-}
+		sort.Strings(names)
 
-func serveCheck(w http.ResponseWriter, r *http.Request) {
-	suppliedToken := r.Header.Get("Authorization")
+		for _, name := range names {
+			profile := selectable.Profiles[name]
+			log.Printf("profile %s: check %v, in %v, out %v, env %v", name, profile.Check, profile.In, profile.Out, profile.Env)
+		}
 
-	if suppliedToken != *requiredToken {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("No or wrong auth token"))
-		return
+		if selectable.Default != "" {
+			log.Printf("using profile %s unless the proxy asks for another one", selectable.Default)
+		}
 	}
 
-	ws, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println("upgrade:", err)
-		return
+	operations := []*operation{
+		{name: "check", marker: "C", path: *checkPath, refs: refs, profiles: selectable},
+		{name: "in", marker: "I", path: *inPath, refs: refs, profiles: selectable},
+		{name: "out", marker: "O", path: *outPath, refs: refs, profiles: selectable},
 	}
 
-	defer ws.Close()
-
-	stdinReader, stdinWriter, err := os.Pipe()
+	stubCommands, err := stubs()
 
 	if err != nil {
-		internalError(ws, "stdin:", err)
-		return
+		log.Fatal(err)
 	}
 
-	defer stdinReader.Close()
-	defer stdinWriter.Close()
+	var available int
 
-	stdoutReader, stdoutWriter, err := os.Pipe()
+	for _, op := range operations {
+		if stub, ok := stubCommands[op.name]; ok {
+			if op.path != "" {
+				log.Fatalf("Error: %s cannot be served by both %s and a stub", op.name, op.path)
+			}
 
-	if err != nil {
-		internalError(ws, "stdout:", err)
-		return
-	}
+			op.executable = stub
+			available++
+			log.Printf("serving /%s from a stub", op.name)
+		} else if op.path == "" && *replayDir != "" {
+			op.executable, err = newCassettePlayer(op.name, *replayDir)
 
-	defer stdoutReader.Close()
-	defer stdoutWriter.Close()
+			if err != nil {
+				log.Fatal(err)
+			}
 
-	stderrReader, stderrWriter, err := os.Pipe()
+			available++
+			log.Printf("replaying /%s from %s", op.name, *replayDir)
+		} else if op.path == "" {
+			if selectable == nil {
+				log.Printf("%s is not available", op.name)
+			}
+		} else {
+			var err error
+			op.executable, err = newExecutable(op.name, op.path)
 
-	if err != nil {
-		internalError(ws, "stderr:", err)
-		return
-	}
+			if err != nil {
+				log.Fatal(err)
+			}
 
-	defer stderrReader.Close()
-	defer stderrWriter.Close()
+			available++
+			log.Printf("proxying /%s to %s", op.name, op.path)
 
-	// No environment variables to be passed
-	proc, err := os.StartProcess(checkProgram, []string{checkProgram}, &os.ProcAttr{
-		Files: []*os.File{stdinReader, stdoutWriter, stderrWriter},
-	})
+			// report compile errors early; the build is retried on request
+			if _, err := op.executable.command(); err != nil {
+				log.Println(err)
+			}
+		}
 
-	if err != nil {
-		internalError(ws, "start:", err)
-		return
+		http.Handle("/"+op.name, op)
 	}
 
-	stdinReader.Close()
-	stdoutWriter.Close()
-	stderrWriter.Close()
-
-	stdoutDone := make(chan struct{})
-	go pumpStdout(stdoutReader, ws, stdoutDone, "", "C")
-	go ping(ws, stdoutDone)
-
-	stderrDone := make(chan struct{})
-	go pumpStderr(stderrReader, stderrDone)
-
-	pumpStdin(ws, stdinWriter, "C")
+	if available == 0 && selectable == nil {
+		log.Fatal("Error: none of check, in or out is available")
+	}
 
-	stdinWriter.Close() // Some commands will exit when stdin is closed.
+	if *authorizationPath != "" {
+		a, err := loadAuthorization(*authorizationPath)
 
-	// Other commands need a bonk on the head.
-	if err := proc.Signal(os.Interrupt); err != nil {
-		log.Println("inter:", err)
-	}
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	select {
-	case <-stdoutDone:
-	case <-stderrDone:
-	case <-time.After(time.Second):
-		// A bigger bonk on the head.
-		if err := proc.Signal(os.Kill); err != nil {
-			log.Println("term:", err)
+		for _, op := range operations {
+			op.authorization = a
 		}
-		<-stdoutDone
-	}
 
-	if _, err := proc.Wait(); err != nil {
-		log.Println("wait:", err)
+		log.Printf("authorizing requests according to %d rules", len(a.Rules))
 	}
-}
 
-func serveIn(w http.ResponseWriter, r *http.Request) {
-	suppliedToken := r.Header.Get("Authorization")
+	if *auditPath != "" {
+		a, err := newAudit(*auditPath, int64(*auditMaxSize)*1024*1024, *auditKeep)
 
-	if suppliedToken != *requiredToken {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("No or wrong auth token"))
-		return
-	}
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	ws, err := upgrader.Upgrade(w, r, nil)
+		for _, op := range operations {
+			op.audit = a
+		}
 
-	if err != nil {
-		log.Println("upgrade:", err)
-		return
+		log.Printf("auditing sessions to %s", *auditPath)
 	}
 
-	defer ws.Close()
+	if *overlaysPath != "" {
+		o, err := loadOverlays(*overlaysPath)
 
-	stdinReader, stdinWriter, err := os.Pipe()
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	if err != nil {
-		internalError(ws, "stdin:", err)
-		return
+		for _, op := range operations {
+			op.overlays = o
+		}
+
+		log.Printf("merging %d overlays into the source of matching requests", len(o.Overlays))
 	}
 
-	defer stdinReader.Close()
-	defer stdinWriter.Close()
+	if *faultsPath != "" {
+		f, err := loadFaults(*faultsPath)
+
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	stdoutReader, stdoutWriter, err := os.Pipe()
+		for _, op := range operations {
+			op.faults = f
+		}
 
-	if err != nil {
-		internalError(ws, "stdout:", err)
-		return
+		log.Printf("injecting faults according to %d rules", len(f.Rules))
 	}
 
-	defer stdoutReader.Close()
-	defer stdoutWriter.Close()
+	if *debugListen != "" {
+		d, err := newDebugger(*debugListen, *debugOperations)
 
-	stderrReader, stderrWriter, err := os.Pipe()
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	if err != nil {
-		internalError(ws, "stderr:", err)
-		return
+		for _, op := range operations {
+			op.debugger = d
+		}
+
+		log.Printf("running the resource under %s on request, listening on %s", d.dlv, d.listen)
+	} else if *debugOperations != "" {
+		log.Fatal("Error: --debug-operations requires --debug")
 	}
 
-	defer stderrReader.Close()
-	defer stderrWriter.Close()
+	if *coverageDir != "" {
+		c, err := newCoverage(*coverageDir)
 
-	destination, err := os.MkdirTemp("", "concourse-resource-proxy-server-in-*")
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	if err != nil {
-		internalError(ws, "stderr:", err)
-		return
+		for _, op := range operations {
+			op.coverage = c
+		}
+
+		log.Printf("keeping coverage data in %s", c.dir)
 	}
 
-	defer os.RemoveAll(destination)
+	if *breakOnRequest {
+		b := newBreakpoints()
 
-	// TODO Set received environment variables for inProgram
-	proc, err := os.StartProcess(inProgram, []string{inProgram, destination}, &os.ProcAttr{
-		Files: []*os.File{stdinReader, stdoutWriter, stderrWriter},
-	})
+		for _, op := range operations {
+			op.breakpoints = b
+		}
 
-	if err != nil {
-		internalError(ws, "start:", err)
-		return
+		log.Print("pausing each request for inspection")
 	}
 
-	stdinReader.Close()
-	stdoutWriter.Close()
-	stderrWriter.Close()
+	if *recordDir != "" {
+		rec, err := newRecorder(*recordDir)
 
-	stdoutDone := make(chan struct{})
-	go pumpStdout(stdoutReader, ws, stdoutDone, destination, "I")
-	go ping(ws, stdoutDone)
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	stderrDone := make(chan struct{})
-	go pumpStderr(stderrReader, stderrDone)
+		for _, op := range operations {
+			op.recorder = rec
+		}
 
-	pumpStdin(ws, stdinWriter, "I")
+		log.Printf("recording sessions to %s", *recordDir)
+	}
 
-	stdinWriter.Close() // Some commands will exit when stdin is closed.
+	if *keepDir != "" {
+		rt, err := newRetention(*keepDir, *keepCount, *keepAge)
 
-	// Other commands need a bonk on the head.
-	if err := proc.Signal(os.Interrupt); err != nil {
-		log.Println("inter:", err)
-	}
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	select {
-	case <-stdoutDone:
-	case <-stderrDone:
-	case <-time.After(time.Second):
-		// A bigger bonk on the head.
-		if err := proc.Signal(os.Kill); err != nil {
-			log.Println("term:", err)
+		for _, op := range operations {
+			op.retention = rt
 		}
-		<-stdoutDone
-	}
 
-	if _, err := proc.Wait(); err != nil {
-		log.Println("wait:", err)
+		log.Printf("keeping sessions in %s, latest at %s", *keepDir, filepath.Join(*keepDir, latest))
 	}
 
-	ws.Close()
-}
+	if *pprof {
+		if *recordDir == "" && *keepDir == "" {
+			log.Fatal("Error: --pprof requires --record or --keep")
+		}
 
-func serveOut(w http.ResponseWriter, r *http.Request) {
-	suppliedToken := r.Header.Get("Authorization")
+		for _, op := range operations {
+			op.pprof = true
+		}
 
-	if suppliedToken != *requiredToken {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("No or wrong auth token"))
-		return
+		log.Printf("asking the resource for profiles with %s and %s", profiling.CPUProfileVariable, profiling.HeapProfileVariable)
 	}
 
-	ws, err := upgrader.Upgrade(w, r, nil)
-
-	if err != nil {
-		log.Println("upgrade:", err)
-		return
-	}
+	if *shadowDir != "" {
+		sh, err := newShadow(*shadowDir, *shadowDiffs, *shadowOut)
 
-	defer ws.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	stdinReader, stdinWriter, err := os.Pipe()
+		for _, op := range operations {
+			op.shadow = sh
+		}
 
-	if err != nil {
-		internalError(ws, "stdin:", err)
-		return
+		log.Printf("recording divergences of the candidate to %s; summary at /shadow", *shadowDiffs)
+		http.Handle("/shadow", sh)
 	}
 
-	defer stdinReader.Close()
-	defer stdinWriter.Close()
+	if *tlsAuto != "" {
+		if *tlsCert != "" || *tlsKey != "" {
+			log.Fatal("Error: --tls-auto cannot be combined with --tls-cert or --tls-key")
+		}
 
-	stdoutReader, stdoutWriter, err := os.Pipe()
+		*tlsCert, *tlsKey, err = autoTLS(*tlsAuto, tlsHosts(*addr, *tlsHostNames))
 
-	if err != nil {
-		internalError(ws, "stdout:", err)
-		return
-	}
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	defer stdoutReader.Close()
-	defer stdoutWriter.Close()
+		log.Printf("pass the CA certificate in %s to the proxy as source.ca_cert", filepath.Join(*tlsAuto, caCertFile))
+	}
 
-	stderrReader, stderrWriter, err := os.Pipe()
+	if *tlsCert != "" || *tlsKey != "" {
+		if *tlsCert == "" || *tlsKey == "" {
+			log.Fatal("Error: --tls-cert and --tls-key must be given together")
+		}
 
-	if err != nil {
-		internalError(ws, "stderr:", err)
-		return
-	}
+		server := &http.Server{Addr: *addr}
 
-	defer stderrReader.Close()
-	defer stderrWriter.Close()
-	stdoutDone := make(chan struct{})
+		if clientCAs != nil {
+			server.TLSConfig = &tls.Config{
+				ClientCAs:  clientCAs,
+				ClientAuth: tls.RequireAndVerifyClientCert,
+			}
+		}
 
-	sourceDirectory, err := os.MkdirTemp("", "concourse-resource-proxy-server-out-*")
+		log.Printf("serving TLS with %s", *tlsCert)
+		log.Fatal(server.ListenAndServeTLS(*tlsCert, *tlsKey))
+	}
 
-	if err != nil {
-		internalError(ws, "stderr:", err)
-		return
+	if clientCAs != nil {
+		log.Fatal("Error: --client-ca requires TLS")
 	}
 
-	defer os.RemoveAll(sourceDirectory)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
 
-	// receive files and put them into sourceDirectory so that outProgram can do it's thing
-	models.ReceiveFiles(ws, sourceDirectory, "O", stdoutDone)
+// redactor masks secrets in the log and in session files.
+var redactor *models.Redactor
 
-	// TODO Set received environment variables for inProgram
-	proc, err := os.StartProcess(outProgram, []string{outProgram, sourceDirectory}, &os.ProcAttr{
-		Files: []*os.File{stdinReader, stdoutWriter, stderrWriter},
-	})
+// setUpRedaction masks secrets in the log from now on, using the
+// comma-separated patterns in addition to the sensitive keys.
+func setUpRedaction(patterns string) {
+	var err error
+	redactor, err = models.NewRedactor(strings.Split(patterns, ","))
 
 	if err != nil {
-		internalError(ws, "start:", err)
-		return
+		log.Fatal(err)
 	}
 
-	stdinReader.Close()
-	stdoutWriter.Close()
-	stderrWriter.Close()
-
-	go pumpStdout(stdoutReader, ws, stdoutDone, "", "O")
-	go ping(ws, stdoutDone)
-
-	stderrDone := make(chan struct{})
-	go pumpStderr(stderrReader, stderrDone)
-
-	pumpStdin(ws, stdinWriter, "O")
+	log.SetOutput(redactor.Writer(os.Stderr))
+}
 
-	stdinWriter.Close() // Some commands will exit when stdin is closed.
+// readRequest returns the first text message of the proxy, which is the request
+// for the resource.
+func readRequest(ws *models.Conn) ([]byte, error) {
+	ws.SetReadLimit(maxMessageSize)
+	ws.SetReadDeadline(time.Now().Add(pongWait))
 
-	// Other commands need a bonk on the head.
-	if err := proc.Signal(os.Interrupt); err != nil {
-		log.Println("inter:", err)
-	}
+	for {
+		messageType, message, err := ws.ReadMessage()
 
-	select {
-	case <-stdoutDone:
-	case <-stderrDone:
-	case <-time.After(time.Second):
-		// A bigger bonk on the head.
-		if err := proc.Signal(os.Kill); err != nil {
-			log.Println("term:", err)
+		if err != nil {
+			return nil, err
 		}
-		<-stdoutDone
-	}
 
-	if _, err := proc.Wait(); err != nil {
-		log.Println("wait:", err)
+		if messageType == websocket.TextMessage {
+			return message, nil
+		}
 	}
-
-	ws.Close()
 }
 
-// https://stackoverflow.com/a/22892986/3212907
-func randomToken() string {
-	rand.Seed(time.Now().UnixNano())
-
-	var stock = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890")
+// drain keeps reading from the proxy so that pongs and the closing handshake are
+// processed. gone is closed when the connection ends or no pong arrived within
+// wait.
+func drain(ws *models.Conn, gone chan struct{}, wait time.Duration) {
+	defer close(gone)
+	ws.SetReadDeadline(time.Now().Add(wait))
+	ws.SetPongHandler(func(string) error { ws.SetReadDeadline(time.Now().Add(wait)); return nil })
 
-	b := make([]rune, 32)
-
-	for i := range b {
-		b[i] = stock[rand.Intn(len(stock))]
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			return
+		}
 	}
-
-	return string(b)
 }
 
-func isClosed(ch <-chan struct{}) bool {
-	select {
-	case <-ch:
-		return true
-	default:
+func ping(ws *models.Conn, done chan struct{}) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := ws.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeWait)); err != nil {
+				log.Println("ping:", err)
+			}
+		case <-done:
+			return
+		}
 	}
+}
 
-	return false
+func internalError(ws *models.Conn, msg string, err error) {
+	log.Println(msg, err)
+	ws.WriteMessage(websocket.TextMessage, []byte(msg))
 }
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/suhlig/concourse-resource-proxy/models"
+	"github.com/suhlig/concourse-resource-proxy/profiling"
+)
+
+// operation is one of check, in or out of the resource under development.
+type operation struct {
+	name   string
+	marker string // prefixes the log lines of this operation
+
+	path string // as given on the command line
+
+	// implements the operation; nil if not available
+	executable executable
+
+	// checks out the refs requested by the proxy; nil if not enabled
+	refs *worktrees
+
+	// selected by the proxy; nil if not enabled
+	profiles *profiles
+
+	// runs a candidate in addition; nil if not enabled
+	shadow *shadow
+
+	// records the sessions; nil if not enabled
+	recorder *recorder
+
+	// asks the resource for profiles to add to the recording or kept session
+	pprof bool
+
+	// keeps the directory of each session; nil if not enabled
+	retention *retention
+
+	// limits who may call the operation; nil if not enabled
+	authorization *authorization
+
+	// records each session; nil if not enabled
+	audit *audit
+
+	// merged into the source; nil if not enabled
+	overlays *overlays
+
+	// pause each request; nil if not enabled
+	breakpoints *breakpoints
+
+	// injected into matching sessions; nil if not enabled
+	faults *faults
+
+	// runs the resource on request; nil if not enabled
+	debugger *debugger
+
+	// keeps the coverage data of each session; nil if not enabled
+	coverage *coverage
+}
+
+// requestError is reported to the proxy with status.
+type requestError struct {
+	status  int
+	message string
+}
+
+func (e requestError) Error() string {
+	return e.message
+}
+
+// resolve returns the executable that serves r, as requested by the proxy.
+// Information for the proxy goes into responseHeader.
+func (op *operation) resolve(r *http.Request, responseHeader http.Header) (executable, error) {
+	ref := r.Header.Get(models.RefHeader)
+	profileName := op.profile(r)
+
+	if ref != "" && profileName != "" {
+		return nil, requestError{http.StatusBadRequest, "ref and profile cannot be combined"}
+	}
+
+	if op.profiles != nil && ref == "" {
+		if profileName != "" {
+			exe, err := op.profiles.executable(profileName, op.name)
+
+			if err != nil {
+				return nil, err
+			}
+
+			log.Printf("%s: profile %s handles the request", op.marker, profileName)
+
+			return exe, nil
+		}
+	}
+
+	if profileName != "" {
+		return nil, requestError{http.StatusBadRequest, "profiles are not enabled on the server"}
+	}
+
+	if op.executable == nil {
+		return nil, requestError{http.StatusNotImplemented, models.ErrNotAvailable}
+	}
+
+	if ref == "" {
+		return op.executable, nil
+	}
+
+	if op.refs == nil {
+		return nil, requestError{http.StatusBadRequest, "serving refs is not enabled on the server"}
+	}
+
+	exe, commit, err := op.refs.executable(op, ref)
+
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("%s: serving %s at commit %s", op.marker, ref, commit)
+	responseHeader.Set(models.CommitHeader, commit)
+
+	return exe, nil
+}
+
+// profile returns the name of the profile that the proxy asks for with r, or
+// the default one; empty if none.
+func (op *operation) profile(r *http.Request) string {
+	name := r.Header.Get(models.ProfileHeader)
+
+	if name == "" && op.profiles != nil && r.Header.Get(models.RefHeader) == "" {
+		name = op.profiles.Default
+	}
+
+	return name
+}
+
+// reject tells the proxy why its request cannot be served.
+func (op *operation) reject(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+
+	if e, ok := err.(requestError); ok {
+		status = e.status
+	}
+
+	log.Printf("%s: rejecting request: %s", op.marker, err)
+	models.WriteError(w, status, models.Error{Operation: op.name, Message: err.Error()})
+}
+
+func (op *operation) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	address := clientLimits.address(r)
+
+	// filled in as the session proceeds; written only if auditing is enabled
+	record := &auditRecord{}
+
+	if op.audit != nil {
+		record, w = op.audit.begin(op.name, r, address, w)
+		defer op.audit.write(record)
+	}
+
+	reject := func(err error) {
+		record.Error = err.Error()
+		op.reject(w, err)
+	}
+
+	if err := clientLimits.admit(address); err != nil {
+		reject(err)
+		return
+	}
+
+	responseHeader := http.Header{}
+	identity, encryption, ok := authenticate(r, op.name, responseHeader)
+
+	if !ok {
+		log.Printf("%s: rejecting request from %s: authentication failed", op.marker, address)
+		clientLimits.failed(address)
+		record.Error = "authentication failed"
+		unauthorized(w)
+		return
+	}
+
+	record.Identity = identity
+	caller := newCaller(identity, r)
+	log.Printf("%s: request from %s", op.marker, caller)
+
+	if scheme := r.Header.Get(models.EncryptionHeader); scheme != "" && scheme != models.EncryptionScheme {
+		reject(requestError{http.StatusBadRequest, fmt.Sprintf("unknown encryption scheme %s", scheme)})
+		return
+	}
+
+	if r.Header.Get(models.EncryptionHeader) != "" && encryption == nil {
+		reject(requestError{http.StatusBadRequest, "encryption requires a signed handshake"})
+		return
+	}
+
+	if *requireEncryption && encryption == nil {
+		reject(requestError{http.StatusForbidden, "the server accepts encrypted sessions only"})
+		return
+	}
+
+	if op.authorization != nil && !op.authorization.allows(op.name, caller) {
+		reject(requestError{http.StatusForbidden, fmt.Sprintf("%s is not allowed to run %s", caller, op.name)})
+		return
+	}
+
+	leave, err := clientLimits.enter(identity)
+
+	if err != nil {
+		reject(err)
+		return
+	}
+
+	defer leave()
+
+	debugging := op.debugger != nil && op.debugger.wanted(op.name, r)
+
+	if debugging {
+		release, err := op.debugger.acquire()
+
+		if err != nil {
+			reject(err)
+			return
+		}
+
+		defer release()
+	}
+
+	exe, err := op.resolve(r, responseHeader)
+
+	if err != nil {
+		reject(err)
+		return
+	}
+
+	cmd, err := exe.command()
+
+	if err != nil {
+		reject(err)
+		return
+	}
+
+	if op.audit != nil {
+		op.audit.executable(record, cmd)
+	}
+
+	upgraded, err := upgrader.Upgrade(w, r, responseHeader)
+
+	if err != nil {
+		record.Error = fmt.Sprintf("upgrade: %s", err)
+		log.Println("upgrade:", err)
+		return
+	}
+
+	defer upgraded.Close()
+
+	ws := models.NewConn(upgraded)
+
+	if encryption != nil {
+		ws, err = encryption.Wrap(upgraded, "server")
+
+		if err != nil {
+			record.Error = fmt.Sprintf("encryption: %s", err)
+			log.Println("encryption:", err)
+			return
+		}
+
+		record.Encrypted = true
+		log.Printf("%s: encrypting the session with %s", op.marker, models.EncryptionScheme)
+	}
+
+	fail := func(msg string, err error) {
+		record.Error = fmt.Sprintf("%s %s", msg, err)
+		internalError(ws, msg, err)
+	}
+
+	// in writes the files to return into this directory, out reads the files it
+	// received from it
+	var directory string
+	var kept *keptSession
+
+	if op.retention != nil {
+		kept, err = op.retention.session(op.name)
+
+		if err != nil {
+			fail("session:", err)
+			return
+		}
+
+		defer op.retention.release(kept)
+
+		directory = kept.files
+	} else if op.name != "check" {
+		directory, err = os.MkdirTemp("", "concourse-resource-proxy-server-"+op.name+"-*")
+
+		if err != nil {
+			fail("tempdir:", err)
+			return
+		}
+
+		defer os.RemoveAll(directory)
+	}
+
+	if op.name == "out" {
+		// receive files and put them into directory so that out can do it's thing
+		models.ReceiveFiles(ws, directory, op.marker)
+	}
+
+	request, err := readRequest(ws)
+
+	if err != nil {
+		record.Error = fmt.Sprintf("request: %s", err)
+		log.Println("request:", err)
+		return
+	}
+
+	record.RequestDigest = digest(request)
+
+	log.Printf("%s< %s\n", op.marker, request)
+
+	wait := pongWait
+
+	if debugging {
+		// do not abort the session that is being debugged over a missed pong
+		wait = debugPongWait
+	}
+
+	gone := make(chan struct{})
+	go drain(ws, gone, wait)
+
+	done := make(chan struct{})
+	go ping(ws, done)
+
+	forward := func(line []byte) error {
+		log.Printf("%s> %s", op.marker, line)
+		ws.SetWriteDeadline(time.Now().Add(writeWait))
+
+		if err := ws.WriteMessage(websocket.TextMessage, line); err != nil {
+			log.Printf("E: %s", err)
+			return err
+		}
+
+		return nil
+	}
+
+	var response []byte
+
+	if op.breakpoints != nil {
+		d, err := op.breakpoints.pause(op, request, cmd)
+
+		if err != nil {
+			close(done)
+			fail("breakpoint:", err)
+			return
+		}
+
+		request, cmd, response = d.request, d.cmd, d.response
+
+		if op.audit != nil {
+			op.audit.executable(record, cmd)
+		}
+	}
+
+	var fault *injection
+
+	if op.faults != nil {
+		if i, rule := op.faults.pick(op.name, request); rule != nil {
+			log.Printf("%s: injecting fault #%d", op.marker, i+1)
+			fault = &injection{rule: rule, ws: ws}
+			forward = fault.forward(forward)
+			fault.delay()
+
+			if rule.EmptyCheck && op.name == "check" {
+				response = []byte("[]")
+			}
+		}
+	}
+
+	compareWithCandidate := func(*result) {}
+
+	if op.shadow != nil {
+		compareWithCandidate = op.shadow.run(op, request, directory)
+	}
+
+	// only the resource gets the secrets of the overlays; everything else,
+	// including recordings and kept sessions, sees the request of the proxy
+	merged := request
+
+	if op.overlays != nil {
+		merged, err = op.overlays.apply(op.marker, request, caller, op.profile(r))
+
+		if err != nil {
+			close(done)
+			fail("overlay:", err)
+			return
+		}
+	}
+
+	var resultDirectory string
+
+	// only in sends back files
+	if op.name == "in" {
+		resultDirectory = directory
+	}
+
+	var result *result
+
+	if response != nil {
+		result, err = respond(response, forward)
+	} else {
+		if op.coverage != nil {
+			var sessionDir string
+			cmd, sessionDir, err = op.coverage.session(op.name, r, cmd)
+
+			if err != nil {
+				close(done)
+				fail("coverage:", err)
+				return
+			}
+
+			// only instrumented builds write coverage data
+			defer os.Remove(sessionDir)
+		}
+
+		var profiles string
+
+		if op.pprof {
+			profiles, err = os.MkdirTemp("", "concourse-resource-proxy-server-profiles-*")
+
+			if err != nil {
+				close(done)
+				fail("profiles:", err)
+				return
+			}
+
+			defer os.RemoveAll(profiles)
+
+			cmd = cmd.withEnv(
+				profiling.CPUProfileVariable+"="+filepath.Join(profiles, "cpu.pprof"),
+				profiling.HeapProfileVariable+"="+filepath.Join(profiles, "heap.pprof"),
+			)
+		}
+
+		if debugging {
+			cmd = op.debugger.attach(op.marker, cmd)
+		}
+
+		result, err = execute(cmd, merged, directory, forward, func(line []byte) {
+			log.Printf("E %s", line)
+		}, gone)
+
+		if err == nil {
+			result.profiles = profiles
+			log.Printf("%s: %s", op.marker, result.usage)
+		}
+	}
+
+	close(done)
+
+	if err != nil {
+		fail("execute:", err)
+		return
+	}
+
+	if fault != nil {
+		if fault.rule.ExitStatus != nil {
+			result.ExitStatus = *fault.rule.ExitStatus
+		}
+
+		// not enough lines to drop the connection in between
+		if fault.rule.DropAfterLines != nil {
+			fault.drop()
+		}
+	}
+
+	if resultDirectory != "" {
+		result.Files, err = digestFiles(resultDirectory)
+
+		if err != nil {
+			log.Println("digest:", err)
+		}
+
+		models.SendFiles(ws, resultDirectory)
+	}
+
+	record.ExitStatus = &result.ExitStatus
+	compareWithCandidate(result)
+
+	ws.SetWriteDeadline(time.Now().Add(writeWait))
+	ws.Finish(result.ExitStatus)
+
+	select {
+	case <-gone:
+	case <-time.After(closeGracePeriod):
+	}
+
+	if op.recorder != nil {
+		recorded, err := op.recorder.record(op.name, request, result, directory)
+
+		if err != nil {
+			log.Printf("%s: could not record session: %s", op.marker, err)
+		} else {
+			log.Printf("%s: recorded session to %s", op.marker, recorded)
+		}
+	}
+
+	if kept != nil {
+		if err := op.retention.keep(kept, request, result); err != nil {
+			log.Printf("%s: could not keep session: %s", op.marker, err)
+		} else {
+			log.Printf("%s: kept session in %s", op.marker, kept.dir)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// overlays are merged into the source of matching requests, so that secrets can
+// stay on the workstation while the pipeline sends placeholders.
+type overlays struct {
+	Overlays []*overlay `json:"overlays"`
+
+	dir string // of the file; relative paths of files to interpolate are based here
+}
+
+// overlay applies to the requests that match all of its lists. Entries are
+// patterns like release-*; an empty list matches any request.
+type overlay struct {
+	callerPatterns
+	Profiles []string `json:"profiles"`
+
+	// merged into the source, replacing what the proxy sent; strings may refer
+	// to ((VARIABLE)) or ((file:path))
+	Source map[string]interface{} `json:"source"`
+}
+
+var placeholder = regexp.MustCompile(`\(\(\s*([^()]+?)\s*\)\)`)
+
+func loadOverlays(path string) (*overlays, error) {
+	o := overlays{dir: filepath.Dir(path)}
+
+	if err := loadConfig(path, &o); err != nil {
+		return nil, fmt.Errorf("could not load overlays from %s: %w", path, err)
+	}
+
+	// report missing variables and files early; they are resolved again for
+	// each request
+	for i, overlay := range o.Overlays {
+		if _, err := o.interpolate(overlay.Source); err != nil {
+			return nil, fmt.Errorf("overlay #%d in %s: %w", i+1, path, err)
+		}
+
+		if overlay.claimsOnly() {
+			log.Printf("Warning: overlay #%d in %s relies on the team, pipeline or resource that the proxy claims; limit it to identities, too", i+1, path)
+		}
+	}
+
+	return &o, nil
+}
+
+// apply merges the overlays for c and profile into the source of request, in
+// the order given. It returns request as it is if none of them matches.
+func (o *overlays) apply(marker string, request []byte, c caller, profile string) ([]byte, error) {
+	var parsed map[string]interface{}
+
+	for i, overlay := range o.Overlays {
+		if !overlay.matches(c) || !matchesAny(overlay.Profiles, profile) {
+			continue
+		}
+
+		if parsed == nil {
+			decoder := json.NewDecoder(bytes.NewReader(request))
+			decoder.UseNumber()
+
+			if err := decoder.Decode(&parsed); err != nil {
+				return nil, err
+			}
+		}
+
+		source, err := o.interpolate(overlay.Source)
+
+		if err != nil {
+			return nil, fmt.Errorf("overlay #%d: %w", i+1, err)
+		}
+
+		existing, _ := parsed["source"].(map[string]interface{})
+		parsed["source"] = merge(existing, source.(map[string]interface{}))
+
+		log.Printf("%s: applying overlay #%d to the source", marker, i+1)
+	}
+
+	if parsed == nil {
+		return request, nil
+	}
+
+	return json.Marshal(parsed)
+}
+
+// interpolate returns a copy of value with the placeholders in its strings
+// replaced. The values are masked in the log from now on.
+func (o *overlays) interpolate(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		var err error
+
+		interpolated := placeholder.ReplaceAllStringFunc(v, func(match string) string {
+			resolved, e := o.resolve(placeholder.FindStringSubmatch(match)[1])
+
+			if e != nil {
+				err = e
+			}
+
+			redactor.AddSecret(resolved)
+
+			return resolved
+		})
+
+		return interpolated, err
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+
+		for key, nested := range v {
+			interpolated, err := o.interpolate(nested)
+
+			if err != nil {
+				return nil, err
+			}
+
+			copied[key] = interpolated
+		}
+
+		return copied, nil
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+
+		for i, nested := range v {
+			interpolated, err := o.interpolate(nested)
+
+			if err != nil {
+				return nil, err
+			}
+
+			copied[i] = interpolated
+		}
+
+		return copied, nil
+	default:
+		return value, nil
+	}
+}
+
+// resolve returns the value of the environment variable name, or the contents
+// of the file if name is file:path.
+func (o *overlays) resolve(name string) (string, error) {
+	path := strings.TrimPrefix(name, "file:")
+
+	if path == name {
+		value, ok := os.LookupEnv(name)
+
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+
+		return value, nil
+	}
+
+	if rest := strings.TrimPrefix(path, "~/"); rest != path {
+		home, err := os.UserHomeDir()
+
+		if err != nil {
+			return "", err
+		}
+
+		path = filepath.Join(home, rest)
+	} else if !filepath.IsAbs(path) {
+		path = filepath.Join(o.dir, path)
+	}
+
+	content, err := os.ReadFile(path)
+
+	if err != nil {
+		return "", err
+	}
+
+	// as left by editors and echo
+	return strings.TrimRight(string(content), "\n"), nil
+}
+
+// merge merges src into dst, descending into the objects present in both.
+func merge(dst, src map[string]interface{}) map[string]interface{} {
+	if dst == nil {
+		dst = make(map[string]interface{}, len(src))
+	}
+
+	for key, value := range src {
+		existing, isObject := dst[key].(map[string]interface{})
+		nested, replacesObject := value.(map[string]interface{})
+
+		if isObject && replacesObject {
+			dst[key] = merge(existing, nested)
+		} else {
+			dst[key] = value
+		}
+	}
+
+	return dst
+}
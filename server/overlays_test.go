@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestOverlaysApply(t *testing.T) {
+	setUpRedaction("")
+
+	o := &overlays{Overlays: []*overlay{
+		{
+			callerPatterns: callerPatterns{Identities: []string{"ci"}, Teams: []string{"main"}},
+			Source:         map[string]interface{}{"password": "s3cret", "tls": map[string]interface{}{"verify": true}},
+		},
+		{
+			callerPatterns: callerPatterns{Resources: []string{"time-*"}},
+			Profiles:       []string{"race"},
+			Source:         map[string]interface{}{"verbose": true},
+		},
+	}}
+
+	request := []byte(`{"source":{"password":"((placeholder))","tls":{"ca":"pem"}},"version":{"ref":"1"}}`)
+
+	tests := []struct {
+		name    string
+		caller  caller
+		profile string
+		want    map[string]interface{} // the source
+	}{
+		{
+			name:   "identity and team",
+			caller: caller{identity: "ci", team: "main"},
+			want:   map[string]interface{}{"password": "s3cret", "tls": map[string]interface{}{"ca": "pem", "verify": true}},
+		},
+		{
+			name:   "other identity claiming the team",
+			caller: caller{identity: "colleague", team: "main"},
+			want:   map[string]interface{}{"password": "((placeholder))", "tls": map[string]interface{}{"ca": "pem"}},
+		},
+		{
+			name:   "identity of another team",
+			caller: caller{identity: "ci", team: "other"},
+			want:   map[string]interface{}{"password": "((placeholder))", "tls": map[string]interface{}{"ca": "pem"}},
+		},
+		{
+			name:    "resource and profile",
+			caller:  caller{identity: "colleague", resource: "time-utc"},
+			profile: "race",
+			want:    map[string]interface{}{"password": "((placeholder))", "tls": map[string]interface{}{"ca": "pem"}, "verbose": true},
+		},
+		{
+			name:   "resource without profile",
+			caller: caller{identity: "colleague", resource: "time-utc"},
+			want:   map[string]interface{}{"password": "((placeholder))", "tls": map[string]interface{}{"ca": "pem"}},
+		},
+		{
+			name:    "both",
+			caller:  caller{identity: "ci", team: "main", resource: "time-utc"},
+			profile: "race",
+			want:    map[string]interface{}{"password": "s3cret", "tls": map[string]interface{}{"ca": "pem", "verify": true}, "verbose": true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			applied, err := o.apply("T", request, test.caller, test.profile)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got struct {
+				Source map[string]interface{} `json:"source"`
+			}
+
+			if err := json.Unmarshal(applied, &got); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got.Source, test.want) {
+				t.Errorf("apply() source = %v, want %v", got.Source, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os/exec"
+	"sort"
+
+	"github.com/suhlig/concourse-resource-proxy/models"
+)
+
+// profiles are named sets of commands, e.g. a stable, a debug and a race-enabled
+// build of the resource, that the proxy selects from.
+type profiles struct {
+	// used when the proxy does not ask for a profile; if empty, the
+	// executables given on the command line are used instead
+	Default string `json:"default"`
+
+	Profiles map[string]*profile `json:"profiles"`
+}
+
+type profile struct {
+	// program and arguments per operation
+	Check []string `json:"check"`
+	In    []string `json:"in"`
+	Out   []string `json:"out"`
+
+	// environment of all commands, in addition to the server's one
+	Env map[string]string `json:"env"`
+
+	commands map[string]*command // by operation name
+}
+
+func loadProfiles(path string) (*profiles, error) {
+	var p profiles
+
+	if err := loadConfig(path, &p); err != nil {
+		return nil, fmt.Errorf("could not load profiles from %s: %w", path, err)
+	}
+
+	if _, ok := p.Profiles[p.Default]; p.Default != "" && !ok {
+		return nil, fmt.Errorf("default profile %s is not defined in %s", p.Default, path)
+	}
+
+	for name, profile := range p.Profiles {
+		var env []string
+
+		for key, value := range profile.Env {
+			env = append(env, key+"="+value)
+		}
+
+		sort.Strings(env)
+
+		profile.commands = make(map[string]*command)
+
+		for operation, argv := range map[string][]string{
+			"check": profile.Check,
+			"in":    profile.In,
+			"out":   profile.Out,
+		} {
+			if len(argv) == 0 {
+				continue
+			}
+
+			program, err := exec.LookPath(argv[0])
+
+			if err != nil {
+				return nil, fmt.Errorf("profile %s: %w", name, err)
+			}
+
+			profile.commands[operation] = &command{path: program, args: argv[1:], env: env}
+		}
+	}
+
+	return &p, nil
+}
+
+// executable returns the command of the named profile for operation.
+func (p *profiles) executable(name, operation string) (executable, error) {
+	profile, ok := p.Profiles[name]
+
+	if !ok {
+		return nil, requestError{http.StatusBadRequest, fmt.Sprintf("unknown profile %s", name)}
+	}
+
+	cmd, ok := profile.commands[operation]
+
+	if !ok {
+		return nil, requestError{http.StatusNotImplemented, fmt.Sprintf("%s in profile %s", models.ErrNotAvailable, name)}
+	}
+
+	return cmd, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// runReplay is the replay command. It runs the sessions recorded in a cassette
+// again, this time against the given executables, and reports where their
+// results diverge from the recorded ones. It exits with a non-zero status on
+// divergence, so that it can be used in scripts.
+func runReplay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	cassette := flags.String("cassette", "", "`directory` with the sessions recorded with --record")
+	operation := flags.String("operation", "", "replay only the sessions of this `operation`")
+	replayOut := flags.Bool("replay-out", false, "also run the recorded out sessions, which puts again to the systems they were recorded against")
+	flags.StringVar(resourceDir, "resource-dir", "", "`directory` to discover the check, in and out executables in; explicit paths take precedence")
+	flags.StringVar(checkPath, "check", "", "path to the `check` executable under test")
+	flags.StringVar(inPath, "in", "", "path to the `in` executable under test")
+	flags.StringVar(outPath, "out", "", "path to the `out` executable under test")
+	flags.BoolVar(build, "build", false, "treat the check, in and out paths as Go packages and build them first")
+	flags.StringVar(buildCache, "build-cache", "", "`directory` for the binaries built with --build (default is in the user's cache directory)")
+	flags.StringVar(redactPatterns, "redact", "", "comma-separated regular `expressions` of further JSON keys that were masked when recording")
+	flags.Parse(args)
+	setUpRedaction(*redactPatterns)
+
+	if *cassette == "" {
+		log.Fatal("Error: missing --cassette")
+	}
+
+	if *resourceDir != "" {
+		discoverAll(*resourceDir)
+	}
+
+	executables := make(map[string]executable)
+
+	for name, path := range map[string]string{"check": *checkPath, "in": *inPath, "out": *outPath} {
+		if path == "" {
+			continue
+		}
+
+		exe, err := newExecutable(name, path)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		executables[name] = exe
+	}
+
+	recordings, err := loadCassette(*cassette)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var replayed, diverged, failed int
+
+	for _, r := range recordings {
+		if *operation != "" && r.Operation != *operation {
+			continue
+		}
+
+		if r.Operation == "out" && !*replayOut {
+			log.Printf("skipping %s: out would put again; enable with --replay-out", r.dir)
+			continue
+		}
+
+		exe, ok := executables[r.Operation]
+
+		if !ok {
+			log.Printf("skipping %s: no %s executable given", r.dir, r.Operation)
+			continue
+		}
+
+		replayed++
+
+		d, err := replayAgainst(r, exe)
+
+		switch {
+		case err != nil:
+			failed++
+			fmt.Printf("FAIL %s: %s\n", r.dir, err)
+		case d != nil:
+			diverged++
+			report, _ := json.MarshalIndent(d, "     ", "  ")
+			fmt.Printf("DIFF %s\n     %s\n", r.dir, report)
+		default:
+			fmt.Printf("ok   %s\n", r.dir)
+		}
+	}
+
+	fmt.Printf("%d sessions replayed, %d diverged, %d failed\n", replayed, diverged, failed)
+
+	if diverged > 0 || failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// replayAgainst runs exe with the recorded request and compares its result with
+// the recorded one.
+func replayAgainst(r *recording, exe executable) (*divergence, error) {
+	recorded, err := r.result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var files string
+
+	if r.Operation == "out" {
+		files = r.filesDir()
+	}
+
+	replayed, err := executeIsolated(r.Operation, exe, r.request, files)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// secrets were masked in the recording
+	replayed.Stdout = redactor.Redact(replayed.Stdout)
+
+	return compare(recorded, replayed), nil
+}
+
+// result is what the resource produced in the recorded session.
+func (r *recording) result() (*result, error) {
+	stdout, err := os.ReadFile(filepath.Join(r.dir, "stdout"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	stderr, err := os.ReadFile(filepath.Join(r.dir, "stderr"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	recorded := &result{
+		Stdout:     stdout,
+		Stderr:     stderr,
+		ExitStatus: r.ExitStatus,
+	}
+
+	if r.Operation == "in" {
+		recorded.Files = make(map[string]string)
+
+		if _, err := os.Stat(r.filesDir()); err == nil {
+			recorded.Files, err = digestFiles(r.filesDir())
+
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return recorded, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latest is the symlink to the most recent session kept.
+const latest = "latest"
+
+// retention keeps the working directory of each session for inspection,
+// together with the rest of the session in the layout of a cassette. Sessions
+// are removed when there are more than count, or when they are older than age.
+type retention struct {
+	dir   string
+	count int           // no limit if zero
+	age   time.Duration // no limit if zero
+
+	mu      sync.Mutex
+	running map[string]bool // names of the directories of sessions in progress
+}
+
+func newRetention(dir string, count int, age time.Duration) (*retention, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	return &retention{dir: dir, count: count, age: age, running: make(map[string]bool)}, nil
+}
+
+// session creates the directory for a session of operation that starts now.
+// For in and out, its files subdirectory serves as the working directory.
+func (rt *retention) session(operation string) (*keptSession, error) {
+	s := &keptSession{
+		operation: operation,
+		started:   time.Now().UTC(),
+	}
+
+	s.dir = filepath.Join(rt.dir, sessionDirName(s.started, operation))
+
+	if err := os.Mkdir(s.dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	rt.mu.Lock()
+	rt.running[filepath.Base(s.dir)] = true
+	rt.mu.Unlock()
+
+	if operation != "check" {
+		s.files = filepath.Join(s.dir, "files")
+
+		if err := os.Mkdir(s.files, os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// keep writes the rest of the session next to its files, points the latest
+// symlink at it and removes the sessions that are not to be kept anymore.
+func (rt *retention) keep(s *keptSession, request []byte, result *result) error {
+	if err := writeSession(s.dir, s.operation, s.started, request, result); err != nil {
+		return err
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	delete(rt.running, filepath.Base(s.dir))
+
+	// replace the symlink atomically
+	link := filepath.Join(rt.dir, latest)
+	tmp := link + ".tmp"
+	os.Remove(tmp)
+
+	if err := os.Symlink(filepath.Base(s.dir), tmp); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, link); err != nil {
+		return err
+	}
+
+	rt.cleanup(filepath.Base(s.dir))
+
+	return nil
+}
+
+// release marks s as no longer in progress, e.g. when it ended before it could
+// be kept.
+func (rt *retention) release(s *keptSession) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	delete(rt.running, filepath.Base(s.dir))
+}
+
+// cleanup removes the sessions beyond count and those older than age. Sessions
+// in progress are neither counted nor removed, and neither is the one that was
+// just kept, which latest points to.
+func (rt *retention) cleanup(kept string) {
+	entries, err := os.ReadDir(rt.dir)
+
+	if err != nil {
+		log.Printf("could not clean up %s: %s", rt.dir, err)
+		return
+	}
+
+	var sessions []string
+
+	for _, entry := range entries {
+		if entry.IsDir() && !rt.running[entry.Name()] {
+			sessions = append(sessions, entry.Name())
+		}
+	}
+
+	// the names start with the time of the session
+	sort.Sort(sort.Reverse(sort.StringSlice(sessions)))
+
+	for i, name := range sessions {
+		expired := rt.count > 0 && i >= rt.count
+
+		if rt.age > 0 {
+			started, err := time.Parse("20060102T150405.000000000Z", strings.SplitN(name, "-", 2)[0])
+			expired = expired || (err == nil && time.Since(started) > rt.age)
+		}
+
+		if !expired || name == kept {
+			continue
+		}
+
+		if err := os.RemoveAll(filepath.Join(rt.dir, name)); err != nil {
+			log.Printf("could not remove session %s: %s", name, err)
+		}
+	}
+}
+
+// keptSession is a session whose directory is kept.
+type keptSession struct {
+	operation string
+	started   time.Time
+	dir       string
+	files     string // working directory of in and out; empty for check
+}
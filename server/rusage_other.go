@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package main
+
+import "os"
+
+func maxRSS(state *os.ProcessState) int64 {
+	return 0
+}
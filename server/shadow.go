@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// shadow runs a candidate build of the resource for each request in addition
+// to the one that serves it (the baseline), and records where their results
+// diverge. The proxy only ever sees the baseline's result.
+type shadow struct {
+	executables map[string]executable // by operation name
+
+	mu      sync.Mutex
+	diffs   *os.File
+	summary map[string]*shadowSummary // by operation name
+}
+
+// shadowSummary counts the sessions of an operation and their divergences.
+type shadowSummary struct {
+	Sessions   int `json:"sessions"`
+	Diverged   int `json:"diverged"`
+	Stdout     int `json:"stdout"`
+	ExitStatus int `json:"exit_status"`
+	Files      int `json:"files"`
+	Failed     int `json:"failed"` // candidate could not be run
+}
+
+// shadowRecord is written to the diffs file for each divergent session.
+type shadowRecord struct {
+	Time      time.Time       `json:"time"`
+	Operation string          `json:"operation"`
+	Request   json.RawMessage `json:"request"`
+	Error     string          `json:"error,omitempty"`
+	*divergence
+}
+
+// newShadow uses the candidate executables found below dir and appends the
+// divergences to diffsPath. The candidate's out only runs with withOut, as it
+// puts for real.
+func newShadow(dir, diffsPath string, withOut bool) (*shadow, error) {
+	sh := &shadow{
+		executables: make(map[string]executable),
+		summary:     make(map[string]*shadowSummary),
+	}
+
+	for _, name := range []string{"check", "in", "out"} {
+		path, ok := discover(dir, name)
+
+		if !ok {
+			log.Printf("no candidate %s found below %s", name, dir)
+			continue
+		}
+
+		if name == "out" && !withOut {
+			log.Printf("not shadowing out with candidate %s, as it would put a second time; enable with --shadow-out", path)
+			continue
+		}
+
+		exe, err := newExecutable(name, path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		log.Printf("shadowing %s with candidate %s", name, path)
+		sh.executables[name] = exe
+		sh.summary[name] = &shadowSummary{}
+	}
+
+	diffs, err := os.OpenFile(diffsPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sh.diffs = diffs
+
+	return sh, nil
+}
+
+// run starts the candidate of op for request. For out, directory holds the
+// files received from the proxy. The returned function compares the candidate's
+// result with the baseline's one once both are available.
+func (sh *shadow) run(op *operation, request []byte, directory string) func(baseline *result) {
+	exe, ok := sh.executables[op.name]
+
+	if !ok {
+		return func(*result) {}
+	}
+
+	var files string
+
+	// while the baseline has not started yet; directory is removed with the
+	// session
+	if op.name == "out" && directory != "" {
+		var err error
+		files, err = os.MkdirTemp("", "concourse-resource-proxy-server-shadow-*")
+
+		if err == nil {
+			err = copyFiles(directory, files)
+		}
+
+		if err != nil {
+			os.RemoveAll(files)
+
+			return func(*result) {
+				sh.record(op, request, nil, err)
+			}
+		}
+	}
+
+	candidate := make(chan *result, 1)
+	failure := make(chan error, 1)
+
+	go func() {
+		if files != "" {
+			defer os.RemoveAll(files)
+		}
+
+		r, err := executeIsolated(op.name, exe, request, files)
+
+		if err != nil {
+			failure <- err
+			return
+		}
+
+		candidate <- r
+	}()
+
+	return func(baseline *result) {
+		go func() {
+			select {
+			case r := <-candidate:
+				sh.record(op, request, compare(baseline, r), nil)
+			case err := <-failure:
+				sh.record(op, request, nil, err)
+			}
+		}()
+	}
+}
+
+func (sh *shadow) record(op *operation, request []byte, d *divergence, failure error) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	summary := sh.summary[op.name]
+	summary.Sessions++
+
+	if d == nil && failure == nil {
+		log.Printf("%s: candidate agrees with baseline", op.marker)
+		return
+	}
+
+	record := shadowRecord{
+		Time:       time.Now(),
+		Operation:  op.name,
+		Request:    request,
+		divergence: d,
+	}
+
+	if failure != nil {
+		log.Printf("%s: candidate failed: %s", op.marker, failure)
+		summary.Failed++
+		record.Error = failure.Error()
+	} else {
+		log.Printf("%s: candidate diverges from baseline", op.marker)
+		summary.Diverged++
+
+		if d.Stdout != nil {
+			summary.Stdout++
+		}
+
+		if d.ExitStatus != nil {
+			summary.ExitStatus++
+		}
+
+		if d.Files != nil {
+			summary.Files++
+		}
+	}
+
+	line, err := json.Marshal(record)
+
+	if err == nil {
+		_, err = sh.diffs.Write(append(redactor.Redact(line), '\n'))
+	}
+
+	if err != nil {
+		log.Printf("could not record divergence: %s", err)
+	}
+}
+
+// ServeHTTP reports the summary of divergences per operation.
+func (sh *shadow) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	address := clientLimits.address(r)
+
+	if err := clientLimits.admit(address); err != nil {
+		log.Printf("rejecting request for the shadow summary: %s", err)
+		w.WriteHeader(err.(requestError).status)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if _, _, ok := authenticate(r, "shadow", w.Header()); !ok {
+		log.Printf("rejecting request for the shadow summary from %s: authentication failed", address)
+		clientLimits.failed(address)
+		unauthorized(w)
+		return
+	}
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sh.summary)
+}
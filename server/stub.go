@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"text/template"
+	"time"
+)
+
+// The stubs are built into the server: the server runs itself with the stub
+// command as the executable of an operation, so that stubs are served exactly
+// like the resource under development.
+
+// stubs returns the stub commands requested on the command line, by operation.
+func stubs() (map[string]*command, error) {
+	commands := make(map[string]*command)
+
+	for _, stub := range []struct {
+		operation string
+		path      string
+		args      []string
+	}{
+		{"check", *stubCheck, []string{"--versions", *stubCheck, fmt.Sprintf("--rotate=%t", *stubCheckRotate)}},
+		{"in", *stubIn, []string{"--fixture", *stubIn}},
+		{"out", *stubOut, []string{"--version", *stubOut}},
+	} {
+		if stub.path == "" {
+			continue
+		}
+
+		if _, err := os.Stat(stub.path); err != nil {
+			return nil, err
+		}
+
+		cmd, err := self(append([]string{"stub", stub.operation}, stub.args...)...)
+
+		if err != nil {
+			return nil, err
+		}
+
+		commands[stub.operation] = cmd
+	}
+
+	return commands, nil
+}
+
+// runStub is the stub command. It reads the request from STDIN and answers like
+// the given operation of a resource would.
+func runStub(args []string) {
+	log.SetOutput(os.Stderr)
+
+	if len(args) == 0 {
+		log.Fatal("Error: missing operation (check, in or out)")
+	}
+
+	operation := args[0]
+	flags := flag.NewFlagSet("stub "+operation, flag.ExitOnError)
+	versions := flags.String("versions", "", "template `file` with the JSON array of versions that check returns")
+	rotate := flags.Bool("rotate", false, "return only the version following the requested one, starting over after the last one")
+	fixture := flags.String("fixture", "", "`directory` that in copies to its destination")
+	version := flags.String("version", "", "template `file` with the JSON response of out")
+	flags.Parse(args[1:])
+
+	var request map[string]interface{}
+
+	if err := json.NewDecoder(os.Stdin).Decode(&request); err != nil {
+		log.Fatal(err)
+	}
+
+	var (
+		response interface{}
+		err      error
+	)
+
+	switch operation {
+	case "check":
+		response, err = stubCheckResponse(*versions, *rotate, request)
+	case "in":
+		if flags.NArg() < 1 {
+			log.Fatal("Missing parameter for the destination directory")
+		}
+
+		response, err = stubInResponse(*fixture, flags.Arg(0), request)
+	case "out":
+		response, err = renderJSON(*version, request)
+	default:
+		err = fmt.Errorf("unknown operation %s", operation)
+	}
+
+	if err != nil {
+		log.Fatalf("Error: %s", err)
+	}
+
+	if err := json.NewEncoder(os.Stdout).Encode(response); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func stubCheckResponse(versionsPath string, rotate bool, request map[string]interface{}) (interface{}, error) {
+	rendered, err := renderJSON(versionsPath, request)
+
+	if err != nil {
+		return nil, err
+	}
+
+	versions, ok := rendered.([]interface{})
+
+	if !ok {
+		return nil, fmt.Errorf("%s does not contain a JSON array of versions", versionsPath)
+	}
+
+	if !rotate || len(versions) == 0 {
+		return versions, nil
+	}
+
+	// start over with the first version unless the current one is found
+	next := 0
+
+	for i, v := range versions {
+		if reflect.DeepEqual(v, request["version"]) {
+			next = (i + 1) % len(versions)
+			break
+		}
+	}
+
+	return []interface{}{versions[next]}, nil
+}
+
+func stubInResponse(fixture, destination string, request map[string]interface{}) (interface{}, error) {
+	if fixture != "" {
+		if err := copyFiles(fixture, destination); err != nil {
+			return nil, err
+		}
+	}
+
+	return map[string]interface{}{
+		"version":  request["version"],
+		"metadata": []interface{}{},
+	}, nil
+}
+
+// renderJSON executes the template in path with the request as data and parses
+// the result as JSON.
+func renderJSON(path string, request map[string]interface{}) (interface{}, error) {
+	if path == "" {
+		return nil, errors.New("no template given")
+	}
+
+	tmpl, err := template.New(filepath.Base(path)).Funcs(template.FuncMap{
+		"now": func() string { return time.Now().Format(time.RFC3339) },
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).ParseFiles(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var rendered bytes.Buffer
+
+	if err := tmpl.ExecuteTemplate(&rendered, tmpl.Name(), request); err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+
+	if err := json.Unmarshal(rendered.Bytes(), &value); err != nil {
+		return nil, fmt.Errorf("%s did not render valid JSON: %w", path, err)
+	}
+
+	return value, nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Files in the directory of --tls-auto
+const (
+	caCertFile     = "ca.pem"
+	caKeyFile      = "ca-key.pem"
+	serverCertFile = "cert.pem"
+	serverKeyFile  = "key.pem"
+)
+
+// Server certificates are renewed when they expire within this period.
+const renewBefore = 30 * 24 * time.Hour
+
+// autoTLS returns the paths of a server certificate and key for hosts in dir,
+// signed by a CA in the same directory. The CA is created once; the server
+// certificate whenever it does not cover hosts or is about to expire.
+func autoTLS(dir string, hosts []string) (certFile, keyFile string, err error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", err
+	}
+
+	ca, caKey, err := loadOrCreateCA(dir)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	certFile = filepath.Join(dir, serverCertFile)
+	keyFile = filepath.Join(dir, serverKeyFile)
+
+	if current, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil && covers(current, hosts) {
+		return certFile, keyFile, nil
+	}
+
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: hosts[0]},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().AddDate(1, 0, 0),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	if err := createCertificate(template, ca, caKey, certFile, keyFile); err != nil {
+		return "", "", err
+	}
+
+	return certFile, keyFile, nil
+}
+
+func loadOrCreateCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certFile := filepath.Join(dir, caCertFile)
+	keyFile := filepath.Join(dir, caKeyFile)
+
+	if _, err := os.Stat(certFile); errors.Is(err, os.ErrNotExist) {
+		template := &x509.Certificate{
+			Subject:               pkix.Name{CommonName: "concourse-resource-proxy CA"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().AddDate(10, 0, 0),
+			KeyUsage:              x509.KeyUsageCertSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+			MaxPathLenZero:        true,
+		}
+
+		if err := createCertificate(template, nil, nil, certFile, keyFile); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+
+	if !ok {
+		return nil, nil, fmt.Errorf("%s is no ECDSA key", keyFile)
+	}
+
+	return cert, key, nil
+}
+
+// createCertificate writes a certificate from template with a new key, signed
+// by parent. Without parent, the certificate is self-signed.
+func createCertificate(template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return err
+	}
+
+	template.SerialNumber, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+
+	if err != nil {
+		return err
+	}
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+
+	if err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+
+	return os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// covers tells whether pair is valid for all of hosts for a while.
+func covers(pair tls.Certificate, hosts []string) bool {
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+
+	if err != nil || time.Until(cert.NotAfter) < renewBefore {
+		return false
+	}
+
+	for _, host := range hosts {
+		if cert.VerifyHostname(host) != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// tlsHosts returns the names and addresses the server certificate is for: those
+// given, the host of addr and the loopback ones.
+func tlsHosts(addr, given string) []string {
+	var hosts []string
+	seen := make(map[string]bool)
+
+	add := func(host string) {
+		host = strings.TrimSpace(host)
+
+		// e.g. 0.0.0.0 for all interfaces
+		if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+			return
+		}
+
+		if host != "" && !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+
+	for _, host := range strings.Split(given, ",") {
+		add(host)
+	}
+
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		add(host)
+	}
+
+	add("localhost")
+	add("127.0.0.1")
+	add("::1")
+
+	return hosts
+}
+
+// runClientCert is the client-cert command. It creates a certificate for a
+// proxy to authenticate with, signed by the CA of --tls-auto.
+func runClientCert(args []string) {
+	flags := flag.NewFlagSet("client-cert", flag.ExitOnError)
+	dir := flags.String("tls-auto", "", "`directory` with the CA generated by the server")
+	name := flags.String("name", "", "common `name` of the certificate, which identifies the client to the server")
+	out := flags.String("out", ".", "`directory` to write <name>.pem and <name>-key.pem to")
+	flags.Parse(args)
+
+	if *dir == "" || *name == "" {
+		log.Fatal("Error: --tls-auto and --name are required")
+	}
+
+	ca, caKey, err := loadOrCreateCA(*dir)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: *name},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().AddDate(1, 0, 0),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	certFile := filepath.Join(*out, *name+".pem")
+	keyFile := filepath.Join(*out, *name+"-key.pem")
+
+	if err := createCertificate(template, ca, caKey, certFile, keyFile); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("wrote %s and %s; pass them to the proxy as source.client_cert and source.client_key", certFile, keyFile)
+	log.Printf("start the server with --client-ca %s", filepath.Join(*dir, caCertFile))
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/suhlig/concourse-resource-proxy/models"
+)
+
+// tokenVariable is the environment variable with the token, unless it is given
+// with --token. The scripts use it, too.
+const tokenVariable = "WSS_PROXY_TOKEN"
+
+// token is a named token that proxies may authenticate with.
+type token struct {
+	Name    string     `json:"name"`
+	Token   string     `json:"token"`
+	Expires *time.Time `json:"expires"` // never if not given
+}
+
+// tokens are accepted for authentication. Those from the file are reloaded on
+// SIGHUP.
+type tokens struct {
+	path  string // of the tokens file; empty if not given
+	fixed *token // from --token or the environment; nil if not given
+
+	mu      sync.RWMutex
+	entries []*token
+}
+
+func newTokens(fixed, path string) (*tokens, error) {
+	t := &tokens{path: path}
+
+	if fixed != "" {
+		t.fixed = &token{Name: "token", Token: fixed}
+	}
+
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// load reads the tokens file again, if any.
+func (t *tokens) load() error {
+	var entries []*token
+
+	if t.fixed != nil {
+		entries = append(entries, t.fixed)
+	}
+
+	if t.path != "" {
+		var file struct {
+			Tokens []*token `json:"tokens"`
+		}
+
+		if err := loadConfig(t.path, &file); err != nil {
+			return err
+		}
+
+		for i, entry := range file.Tokens {
+			if entry.Name == "" || entry.Token == "" {
+				return fmt.Errorf("%s: token #%d needs a name and a token", t.path, i+1)
+			}
+		}
+
+		entries = append(entries, file.Tokens...)
+	}
+
+	if len(entries) == 0 {
+		return errors.New("no tokens")
+	}
+
+	for _, entry := range entries {
+		redactor.AddSecret(entry.Token)
+	}
+
+	t.mu.Lock()
+	t.entries = entries
+	t.mu.Unlock()
+
+	return nil
+}
+
+// reloadOnHangup reloads the tokens file whenever the server receives SIGHUP.
+func (t *tokens) reloadOnHangup() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	for range hangup {
+		if err := t.load(); err != nil {
+			log.Printf("could not reload tokens, keeping the previous ones: %s", err)
+			continue
+		}
+
+		log.Printf("reloaded tokens: %s", t)
+	}
+}
+
+// check returns the name of the token that supplied is, if it is accepted.
+func (t *tokens) check(supplied string) (string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var matched *token
+
+	// compare with all of them, so that the time taken does not tell which one
+	// matched
+	for _, entry := range t.entries {
+		if subtle.ConstantTimeCompare([]byte(supplied), []byte(entry.Token)) == 1 {
+			matched = entry
+		}
+	}
+
+	if !usable(matched) {
+		return "", false
+	}
+
+	return matched.Name, true
+}
+
+// verify returns the token that signature was made with for operation and
+// header, if it is accepted.
+func (t *tokens) verify(signature models.Signature, operation string, header http.Header) (*token, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var matched *token
+
+	for _, entry := range t.entries {
+		if signature.Verify(entry.Token, operation, header) {
+			matched = entry
+		}
+	}
+
+	return matched, usable(matched)
+}
+
+// usable tells whether entry was found and has not expired.
+func usable(entry *token) bool {
+	if entry == nil {
+		return false
+	}
+
+	if entry.Expires != nil && time.Now().After(*entry.Expires) {
+		log.Printf("token %s expired at %s", entry.Name, entry.Expires)
+		return false
+	}
+
+	return true
+}
+
+// String lists the names of the tokens, but not the tokens themselves.
+func (t *tokens) String() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var names []string
+
+	for _, entry := range t.entries {
+		if entry.Expires != nil {
+			names = append(names, fmt.Sprintf("%s (expires %s)", entry.Name, entry.Expires.Format(time.RFC3339)))
+		} else {
+			names = append(names, entry.Name)
+		}
+	}
+
+	return fmt.Sprint(names)
+}
+
+// randomToken returns a new token from a cryptographically secure source.
+func randomToken() string {
+	var stock = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890")
+
+	b := make([]rune, 32)
+
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(stock))))
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		b[i] = stock[n.Int64()]
+	}
+
+	return string(b)
+}
+
+// isTerminal tells whether file is a terminal rather than a file or pipe.
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// runToken is the token command. It prints a new token, or an entry for the
+// tokens file, to STDOUT only.
+func runToken(args []string) {
+	flags := flag.NewFlagSet("token", flag.ExitOnError)
+	name := flags.String("name", "", "print an entry for the tokens file with this `name`")
+	expiresIn := flags.Duration("expires-in", 0, "let the entry expire after this `duration`")
+	flags.Parse(args)
+
+	if *name == "" {
+		if *expiresIn != 0 {
+			log.Fatal("Error: --expires-in requires --name")
+		}
+
+		fmt.Println(randomToken())
+		return
+	}
+
+	fmt.Printf("- name: %q\n  token: %s\n", *name, randomToken())
+
+	if *expiresIn != 0 {
+		fmt.Printf("  expires: %s\n", time.Now().Add(*expiresIn).UTC().Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// digestFiles returns the SHA-256 of each regular file below dir, by path
+// relative to dir.
+func digestFiles(dir string) (map[string]string, error) {
+	digests := make(map[string]string)
+
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(dir, path)
+
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(path)
+
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+
+		hash := sha256.New()
+
+		if _, err := io.Copy(hash, f); err != nil {
+			return err
+		}
+
+		digests[filepath.ToSlash(relativePath)] = fmt.Sprintf("%x", hash.Sum(nil))
+
+		return nil
+	})
+
+	return digests, err
+}
+
+// copyFiles copies the regular files and directories below src to dst.
+func copyFiles(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relativePath, err := filepath.Rel(src, path)
+
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dst, relativePath)
+
+		if entry.IsDir() {
+			return os.MkdirAll(target, os.ModePerm)
+		}
+
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := entry.Info()
+
+		if err != nil {
+			return err
+		}
+
+		in, err := os.Open(path)
+
+		if err != nil {
+			return err
+		}
+
+		defer in.Close()
+
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+
+		return out.Close()
+	})
+}
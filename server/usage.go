@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// usage is what executing a command took.
+type usage struct {
+	Wall   duration `json:"wall"`
+	User   duration `json:"user"`
+	System duration `json:"system"`
+	MaxRSS int64    `json:"max_rss"` // bytes; 0 if unknown on this platform
+}
+
+func newUsage(wall time.Duration, state *os.ProcessState) *usage {
+	return &usage{
+		Wall:   duration(wall),
+		User:   duration(state.UserTime()),
+		System: duration(state.SystemTime()),
+		MaxRSS: maxRSS(state),
+	}
+}
+
+func (u *usage) String() string {
+	return fmt.Sprintf("took %s (user %s, system %s), max RSS %.1f MB",
+		time.Duration(u.Wall), time.Duration(u.User), time.Duration(u.System), float64(u.MaxRSS)/(1<<20))
+}
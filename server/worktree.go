@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// commitID matches full and abbreviated commit ids.
+var commitID = regexp.MustCompile(`^[0-9a-fA-F]{4,40}$`)
+
+// worktrees checks out refs of the resource's git repository side by side, so
+// that each ref can be served from its own worktree.
+type worktrees struct {
+	repo string
+	dir  string
+
+	mu          sync.Mutex
+	executables map[string]executable // by commit and operation name
+}
+
+func newWorktrees(repo, dir string) (*worktrees, error) {
+	repo, err := filepath.Abs(repo)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if dir == "" {
+		cacheDir, err := defaultCacheDir()
+
+		if err != nil {
+			return nil, err
+		}
+
+		dir = filepath.Join(cacheDir, "worktrees")
+	}
+
+	return &worktrees{
+		repo:        repo,
+		dir:         dir,
+		executables: make(map[string]executable),
+	}, nil
+}
+
+// executable returns the executable of op as of ref, together with the commit
+// ref resolved to.
+func (w *worktrees) executable(op *operation, ref string) (executable, string, error) {
+	if err := w.checkRef(ref); err != nil {
+		return nil, "", err
+	}
+
+	commit, err := w.git("rev-parse", "--verify", "--quiet", "--end-of-options", ref+"^{commit}")
+
+	if err != nil {
+		return nil, "", fmt.Errorf("could not resolve ref %s in %s", ref, w.repo)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	key := commit + "/" + op.name
+
+	if exe, ok := w.executables[key]; ok {
+		return exe, commit, nil
+	}
+
+	relativePath, err := w.relative(op.path)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	worktree := filepath.Join(w.dir, commit)
+
+	if _, err := os.Stat(worktree); os.IsNotExist(err) {
+		log.Printf("checking out %s (%s) to %s", ref, commit, worktree)
+
+		if _, err := w.git("worktree", "add", "--detach", "--end-of-options", worktree, commit); err != nil {
+			return nil, "", err
+		}
+	}
+
+	exe, err := newExecutable(op.name, filepath.Join(worktree, relativePath))
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	w.executables[key] = exe
+
+	return exe, commit, nil
+}
+
+// checkRef makes sure that ref, which comes from the proxy, is the name of a
+// ref or a commit, so that it cannot pass options to git.
+func (w *worktrees) checkRef(ref string) error {
+	invalid := requestError{http.StatusBadRequest, fmt.Sprintf("invalid ref %q", ref)}
+
+	if strings.HasPrefix(ref, "-") {
+		return invalid
+	}
+
+	if commitID.MatchString(ref) {
+		return nil
+	}
+
+	if _, err := w.git("check-ref-format", "--allow-onelevel", ref); err != nil {
+		return invalid
+	}
+
+	return nil
+}
+
+// relative returns path relative to the root of the repository.
+func (w *worktrees) relative(path string) (string, error) {
+	path, err := filepath.Abs(path)
+
+	if err != nil {
+		return "", err
+	}
+
+	relativePath, err := filepath.Rel(w.repo, path)
+
+	if err != nil || strings.HasPrefix(relativePath, "..") {
+		return "", fmt.Errorf("%s is not part of the repository %s", path, w.repo)
+	}
+
+	return relativePath, nil
+}
+
+func (w *worktrees) git(args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", w.repo}, args...)...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+
+	if err != nil {
+		if stderr.Len() > 0 {
+			return "", fmt.Errorf("git %s: %s", strings.Join(args, " "), strings.TrimSpace(stderr.String()))
+		}
+
+		return "", err
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestWorktreesCheckRef(t *testing.T) {
+	w := &worktrees{repo: t.TempDir()}
+
+	tests := []struct {
+		ref  string
+		want bool
+	}{
+		{ref: "main", want: true},
+		{ref: "feature/retry", want: true},
+		{ref: "v1.2.3", want: true},
+		{ref: "HEAD", want: true},
+		{ref: "87c4e44", want: true},
+		{ref: "87c4e442165a781dbc77869d27f8d49a488a8f07", want: true},
+		{ref: "--output=/tmp/x"},
+		{ref: "-h"},
+		{ref: "main^{tree}"},
+		{ref: "main..other"},
+		{ref: "main~1"},
+		{ref: "with space"},
+		{ref: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.ref, func(t *testing.T) {
+			if err := w.checkRef(test.ref); (err == nil) != test.want {
+				t.Errorf("checkRef(%q) = %v, want valid %v", test.ref, err, test.want)
+			}
+		})
+	}
+}